@@ -1,23 +1,34 @@
 package cmdsession
 
 import (
+	"bytes"
+	"context"
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os/exec"
+	"strings"
+	"time"
 )
 
 type ExecutionClient interface {
-	Connect() error
+	// Connect establishes the connection to the host, abandoning it if ctx is cancelled first
+	Connect(ctx context.Context) error
 	Close() error
 	NewCmdSession() (CmdSession, error)
+	// Dial opens a connection to the address as seen from the host on which commands are executed
+	Dial(ctx context.Context, network string, addr string) (net.Conn, error)
 }
 
 type DummyCmdSession struct {
 }
 
-func (cs *DummyCmdSession) Execute(stdin io.Reader, cmd ...string) ([]byte, error) {
-	return nil, nil
+func (cs *DummyCmdSession) SetOutputStreams(stdout io.Writer, stderr io.Writer) {
+}
+
+func (cs *DummyCmdSession) Execute(ctx context.Context, stdin io.Reader, cmd ...string) ([]byte, []byte, error) {
+	return nil, nil, nil
 }
 
 func NewDummyExecutionClient() *DummyExecutionClient {
@@ -27,7 +38,7 @@ func NewDummyExecutionClient() *DummyExecutionClient {
 type DummyExecutionClient struct {
 }
 
-func (c *DummyExecutionClient) Connect() error {
+func (c *DummyExecutionClient) Connect(ctx context.Context) error {
 	return nil
 }
 
@@ -39,6 +50,10 @@ func (c *DummyExecutionClient) NewCmdSession() (CmdSession, error) {
 	return &DummyCmdSession{}, nil
 }
 
+func (c *DummyExecutionClient) Dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("unable to dial %s, the dummy client has no network", addr)
+}
+
 type SessionError struct {
 	msg  string
 	args []any
@@ -52,7 +67,8 @@ func NewSessionError(msg string, args ...any) *SessionError {
 }
 
 type ExitCodeError struct {
-	code int
+	code   int
+	stderr string
 }
 
 func NewExitCodeError(code int) *ExitCodeError {
@@ -61,16 +77,47 @@ func NewExitCodeError(code int) *ExitCodeError {
 	}
 }
 
+// NewExitCodeErrorWithStderr creates an exit code error which explains itself with the stderr of the command
+func NewExitCodeErrorWithStderr(code int, stderr []byte) *ExitCodeError {
+	return &ExitCodeError{
+		code:   code,
+		stderr: strings.TrimSpace(string(stderr)),
+	}
+}
+
 func (ec *ExitCodeError) Error() string {
+	if ec.stderr != "" {
+		return fmt.Sprintf("exited with a status of %d\n%s", ec.code, ec.stderr)
+	}
 	return fmt.Sprintf("exited with a status of %d", ec.code)
 }
 
+// TimeoutError indicates that a command was terminated because it ran for longer than it was allowed to
+type TimeoutError struct {
+	timeout time.Duration
+}
+
+func NewTimeoutError(timeout time.Duration) *TimeoutError {
+	return &TimeoutError{
+		timeout: timeout,
+	}
+}
+
+func (te *TimeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", te.timeout)
+}
+
 func (se *SessionError) Error() string {
 	return fmt.Sprintf(se.msg, se.args...)
 }
 
 type CmdSession interface {
-	Execute(stdin io.Reader, cmd ...string) ([]byte, error)
+	// SetOutputStreams causes output to be written to the provided writers as it arrives, in addition to stdout
+	// being returned by Execute
+	SetOutputStreams(stdout io.Writer, stderr io.Writer)
+	// Execute runs the command, returning its stdout and stderr, which are also returned alongside any exit code error.
+	// cancelling ctx terminates the command, returning the cause of the cancellation.
+	Execute(ctx context.Context, stdin io.Reader, cmd ...string) ([]byte, []byte, error)
 }
 
 func IsSessionError(err error) bool {
@@ -78,6 +125,11 @@ func IsSessionError(err error) bool {
 	return errors.As(err, &sessionError)
 }
 
+func IsTimeoutError(err error) bool {
+	var timeoutError *TimeoutError
+	return errors.As(err, &timeoutError)
+}
+
 func GetExitCode(err error) (int, bool) {
 	var exitCodeError *ExitCodeError
 	if !errors.As(err, &exitCodeError) {
@@ -94,7 +146,7 @@ func NewLocalExecutionClient() *LocalExecutionClient {
 	return &LocalExecutionClient{}
 }
 
-func (c *LocalExecutionClient) Connect() error {
+func (c *LocalExecutionClient) Connect(ctx context.Context) error {
 	return nil
 }
 
@@ -106,22 +158,49 @@ func (c *LocalExecutionClient) NewCmdSession() (CmdSession, error) {
 	return &LocalCmdSession{}, nil
 }
 
+func (c *LocalExecutionClient) Dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
 type LocalCmdSession struct {
+	stdout io.Writer
+	stderr io.Writer
 }
 
-func (c *LocalCmdSession) Execute(stdin io.Reader, cmd ...string) ([]byte, error) {
-	com := exec.Command(cmd[0], cmd[1:]...)
+func (c *LocalCmdSession) SetOutputStreams(stdout io.Writer, stderr io.Writer) {
+	c.stdout = stdout
+	c.stderr = stderr
+}
+
+func (c *LocalCmdSession) Execute(ctx context.Context, stdin io.Reader, cmd ...string) ([]byte, []byte, error) {
+	com := exec.CommandContext(ctx, cmd[0], cmd[1:]...)
+	// children which inherit the output pipes would otherwise hold up the return of a killed command
+	com.WaitDelay = time.Second
 	if stdin != nil {
 		com.Stdin = stdin
 	}
-	outBytes, err := com.Output()
+
+	var stdout, stderr bytes.Buffer
+	com.Stdout = &stdout
+	com.Stderr = &stderr
+	if c.stdout != nil {
+		com.Stdout = io.MultiWriter(&stdout, c.stdout)
+		com.Stderr = io.MultiWriter(&stderr, c.stderr)
+	}
+
+	err := com.Run()
 	if err != nil {
+		if ctx.Err() != nil {
+			return stdout.Bytes(), stderr.Bytes(), context.Cause(ctx)
+		}
+
 		if exitError, ok := err.(*exec.ExitError); ok {
-			return nil, NewExitCodeError(exitError.ExitCode())
+			return stdout.Bytes(), stderr.Bytes(), NewExitCodeError(exitError.ExitCode())
 		}
 
-		return nil, err
+		return nil, nil, err
 	}
 
-	return outBytes, nil
+	return stdout.Bytes(), stderr.Bytes(), nil
 }
@@ -1,8 +1,11 @@
 package cmdsession
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -20,3 +23,49 @@ func TestGetExitCode(t *testing.T) {
 	assert.True(t, ok)
 	assert.Equal(t, ec, 1)
 }
+
+func TestLocalCmdSessionStreamsOutput(t *testing.T) {
+	sess, err := NewLocalExecutionClient().NewCmdSession()
+	assert.NoError(t, err)
+
+	var stdout, stderr bytes.Buffer
+	sess.SetOutputStreams(&stdout, &stderr)
+	output, errOutput, err := sess.Execute(context.Background(), nil, "sh", "-c", "echo out; echo err >&2")
+	assert.NoError(t, err)
+	assert.Equal(t, "out\n", string(output))
+	assert.Equal(t, "err\n", string(errOutput))
+	assert.Equal(t, "out\n", stdout.String())
+	assert.Equal(t, "err\n", stderr.String())
+}
+
+func TestLocalCmdSessionCapturesStderrOnFailure(t *testing.T) {
+	sess, err := NewLocalExecutionClient().NewCmdSession()
+	assert.NoError(t, err)
+
+	output, errOutput, err := sess.Execute(context.Background(), nil, "sh", "-c", "echo partial; echo 'no such package' >&2; exit 100")
+	ec, ok := GetExitCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, 100, ec)
+	assert.Equal(t, "partial\n", string(output))
+	assert.Equal(t, "no such package\n", string(errOutput))
+}
+
+func TestExitCodeErrorWithStderr(t *testing.T) {
+	assert.Equal(t, "exited with a status of 100", NewExitCodeErrorWithStderr(100, []byte("\n")).Error())
+	assert.Equal(t, "exited with a status of 100\nE: unable to locate package", NewExitCodeErrorWithStderr(100, []byte("E: unable to locate package\n")).Error())
+}
+
+func TestLocalCmdSessionCancellation(t *testing.T) {
+	sess, err := NewLocalExecutionClient().NewCmdSession()
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 100*time.Millisecond, NewTimeoutError(100*time.Millisecond))
+	defer cancel()
+
+	start := time.Now()
+	_, _, err = sess.Execute(ctx, nil, "sleep", "5")
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.True(t, IsTimeoutError(err))
+	_, ok := GetExitCode(err)
+	assert.False(t, ok)
+}
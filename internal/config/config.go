@@ -5,6 +5,7 @@ import (
 	"os"
 	"os/user"
 	"sync"
+	"time"
 
 	"github.com/frozengoats/crucible/internal/defaults"
 	"github.com/frozengoats/crucible/internal/ssh"
@@ -33,6 +34,7 @@ type Executor struct {
 	ShellBinary        string    `yaml:"shellBinary" default:"sh"`
 	Ssh                SshConfig `yaml:"ssh"`
 	SyncExecutionSteps bool      `yaml:"syncExecutionSteps"` // if true, execution step must complete on all hosts before advancing
+	FactsPath          string    `yaml:"factsPath"`          // directory holding the persisted facts of each host, ~/crucible/facts if unset
 }
 
 type HostConfig struct {
@@ -56,6 +58,10 @@ type Config struct {
 	User        *UserConfig
 	Debug       bool
 	Json        bool
+	Check       bool
+	Diff        bool
+	Stream      bool
+	Timeout     time.Duration
 	CwdPath     string
 	sudoPass    string
 	lock        sync.Mutex
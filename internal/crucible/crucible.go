@@ -7,6 +7,7 @@ import (
 	"path/filepath"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/frozengoats/crucible/internal/config"
 	"github.com/frozengoats/crucible/internal/executor"
@@ -17,6 +18,17 @@ import (
 	"github.com/goccy/go-yaml"
 )
 
+// RunOptions holds the switches which alter how a sequence is run
+type RunOptions struct {
+	Debug  bool // enable debug logging and context capture
+	Json   bool // output results in json format, suppressing normal logging
+	Check  bool // evaluate the sequence and report what would be executed, without executing anything
+	Diff   bool // display the differences between remote files and their rendered replacements
+	Stream bool // log the output of commands as it arrives
+
+	Timeout time.Duration // maximum duration of the whole run, zero for no limit
+}
+
 type Recipe struct {
 	Version     string            `yaml:"version"`
 	Name        string            `yaml:"name"`
@@ -317,7 +329,7 @@ func DownloadRecipe(url string, force bool) error {
 	return oci.Download(imageDescriptor, force)
 }
 
-func ExecuteSequenceFromCwd(cwdPath string, extraConfigPaths []string, extraValuesPaths []string, sequence string, targets []string, debug bool, jsonOutput bool) ([]byte, error) {
+func ExecuteSequenceFromCwd(cwdPath string, extraConfigPaths []string, extraValuesPaths []string, sequence string, targets []string, options *RunOptions) ([]byte, error) {
 	if oci.IsOciUrl(cwdPath) {
 		imageDescriptor, err := oci.NewImageDescriptor(cwdPath)
 		if err != nil {
@@ -411,17 +423,21 @@ func ExecuteSequenceFromCwd(cwdPath string, extraConfigPaths []string, extraValu
 	if len(targets) == 1 && targets[0] == "all" {
 		targets = nil
 	}
-	return executeSequence(recipe, cwdPath, extraConfigPaths, extraValuesPaths, sequencePath, targets, debug, jsonOutput)
+	return executeSequence(recipe, cwdPath, extraConfigPaths, extraValuesPaths, sequencePath, targets, options)
 }
 
-func executeSequence(recipe *Recipe, cwdPath string, configPaths []string, valuesPaths []string, sequencePath string, targets []string, debug bool, jsonOutput bool) ([]byte, error) {
+func executeSequence(recipe *Recipe, cwdPath string, configPaths []string, valuesPaths []string, sequencePath string, targets []string, options *RunOptions) ([]byte, error) {
 	configObj, err := config.FromFilePaths(configPaths...)
 	if err != nil {
 		return nil, err
 	}
 
 	configObj.CwdPath = cwdPath
-	configObj.Debug = debug
+	configObj.Debug = options.Debug
+	configObj.Check = options.Check
+	configObj.Diff = options.Diff
+	configObj.Stream = options.Stream
+	configObj.Timeout = options.Timeout
 	if configObj.Debug {
 		log.SetLevel(log.DEBUG)
 	} else {
@@ -432,6 +448,9 @@ func executeSequence(recipe *Recipe, cwdPath string, configPaths []string, value
 	if strings.Contains(configObj.Executor.Ssh.KeyPath, "~") {
 		configObj.Executor.Ssh.KeyPath = strings.ReplaceAll(configObj.Executor.Ssh.KeyPath, "~", configObj.User.HomeDir)
 	}
+	if strings.Contains(configObj.Executor.FactsPath, "~") {
+		configObj.Executor.FactsPath = strings.ReplaceAll(configObj.Executor.FactsPath, "~", configObj.User.HomeDir)
+	}
 	if strings.Contains(configObj.Executor.Ssh.KnownHostsPath, "~") {
 		configObj.Executor.Ssh.KnownHostsPath = strings.ReplaceAll(configObj.Executor.Ssh.KnownHostsPath, "~", configObj.User.HomeDir)
 	}
@@ -441,7 +460,7 @@ func executeSequence(recipe *Recipe, cwdPath string, configPaths []string, value
 		}
 	}
 
-	if jsonOutput {
+	if options.Json {
 		log.SetLevel(log.SILENT)
 		configObj.Json = true
 	}
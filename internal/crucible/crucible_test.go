@@ -159,8 +159,10 @@ func (suite *CrucibleTestSuite) TestEndToEnd() {
 		nil,
 		"test",
 		[]string{"testServer"},
-		true,
-		true,
+		&RunOptions{
+			Debug: true,
+			Json:  true,
+		},
 	)
 	suite.NoError(err)
 	m := map[string]any{}
@@ -1,10 +1,15 @@
 package executor
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
+	"os"
+	"os/signal"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/frozengoats/crucible/internal/cmdsession"
@@ -22,15 +27,59 @@ type ResultObj struct {
 	FailCount    int             `json:"failCount"`
 	SuccessHosts []string        `json:"successHosts"`
 	FailHosts    []*FailedHost   `json:"failHosts"`
+	Interrupted  bool            `json:"interrupted,omitempty"` // the run was stopped by SIGINT/SIGTERM before every host completed
+
+	Stats    map[string]*sequence.ActionStats     `json:"stats"`              // per host tallies of ok, changed, skipped and failed actions
+	Plans    map[string][]*sequence.PlannedAction `json:"plans,omitempty"`    // per host planned actions, populated only in check mode
+	Messages map[string][]*sequence.DebugMessage  `json:"messages,omitempty"` // per host messages reported by debug actions
 }
 
 type FailedHost struct {
 	Identity    string `json:"identity"`
 	Error       string
+	TimedOut    bool   `json:"timedOut,omitempty"`    // the host failed because an action or the run exceeded its timeout
+	Interrupted bool   `json:"interrupted,omitempty"` // the host was stopped by SIGINT/SIGTERM before completing
+	Step        string `json:"step,omitempty"`        // description of the action the host was processing, or last processed
 	Contexts    []*sequence.ActionContext
 	FullContext json.RawMessage
 }
 
+// InterruptedError indicates that the run was stopped by a signal
+type InterruptedError struct {
+	signal os.Signal
+}
+
+func (ie *InterruptedError) Error() string {
+	return fmt.Sprintf("interrupted by %s", ie.signal)
+}
+
+func IsInterruptedError(err error) bool {
+	var interruptedError *InterruptedError
+	return errors.As(err, &interruptedError)
+}
+
+// trapInterrupts returns a context which is cancelled upon SIGINT or SIGTERM, after which the default handling of the
+// signals is restored so that a second signal terminates the process immediately
+func trapInterrupts(ctx context.Context) (context.Context, func()) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-sigChan:
+			signal.Stop(sigChan)
+			log.Error(nil, "received %s, terminating running commands (repeat to exit immediately)", sig)
+			cancel(&InterruptedError{signal: sig})
+		case <-ctx.Done():
+		}
+	}()
+
+	return ctx, func() {
+		signal.Stop(sigChan)
+		cancel(nil)
+	}
+}
+
 type Executor struct {
 	Config       *config.Config
 	HostConfig   *config.HostConfig
@@ -41,15 +90,12 @@ type Executor struct {
 	sequence          *sequence.Sequence
 	ExecutionInstance *sequence.ExecutionInstance
 	sequenceIndex     int
+	step              string
 }
 
-// NewExecutor creates an executor instance for dealing with a specific host and sequence
-func NewExecutor(cfg *config.Config, hostIdent string, sequencePath string) (*Executor, error) {
-	hostConfig, ok := cfg.Hosts[hostIdent]
-	if !ok {
-		return nil, fmt.Errorf("no host identity \"%s\" exists", hostIdent)
-	}
-
+// newExecutionClient creates the client through which the actions of a host are executed, which is local for a
+// loopback host and ssh otherwise
+var newExecutionClient = func(cfg *config.Config, hostIdent string, hostConfig *config.HostConfig) cmdsession.ExecutionClient {
 	isLoopback := false
 	addrs, err := net.LookupIP(hostConfig.Host)
 	if err == nil {
@@ -62,28 +108,37 @@ func NewExecutor(cfg *config.Config, hostIdent string, sequencePath string) (*Ex
 		}
 	}
 
-	var executionClient cmdsession.ExecutionClient
 	if isLoopback {
-		executionClient = cmdsession.NewLocalExecutionClient()
-	} else {
-		executionClient = ssh.NewSsh(
-			cfg.Hostname(hostIdent),
-			cfg.Port(hostIdent),
-			cfg.Username(hostIdent),
-			cfg.KeyPath(hostIdent),
-			cfg.KnownHostsFile(hostIdent),
-			ssh.WithIgnoreHostKeyChangeOption(cfg.IgnoreHostKeyChange(hostIdent)),
-			ssh.WithAllowUnknownHostsOption(cfg.AllowUnknownHosts(hostIdent)),
-			ssh.WithPassphraseProviderOption(ssh.NewTypedPassphraseProvider()),
-		)
+		return cmdsession.NewLocalExecutionClient()
 	}
+	return ssh.NewSsh(
+		cfg.Hostname(hostIdent),
+		cfg.Port(hostIdent),
+		cfg.Username(hostIdent),
+		cfg.KeyPath(hostIdent),
+		cfg.KnownHostsFile(hostIdent),
+		ssh.WithIgnoreHostKeyChangeOption(cfg.IgnoreHostKeyChange(hostIdent)),
+		ssh.WithAllowUnknownHostsOption(cfg.AllowUnknownHosts(hostIdent)),
+		ssh.WithPassphraseProviderOption(ssh.NewTypedPassphraseProvider()),
+	)
+}
+
+// NewExecutor creates an executor instance for dealing with a specific host and sequence, connecting to the host unless
+// ctx is cancelled first
+func NewExecutor(ctx context.Context, cfg *config.Config, hostIdent string, sequencePath string) (*Executor, error) {
+	hostConfig, ok := cfg.Hosts[hostIdent]
+	if !ok {
+		return nil, fmt.Errorf("no host identity \"%s\" exists", hostIdent)
+	}
+
+	executionClient := newExecutionClient(cfg, hostIdent, hostConfig)
 
 	s, err := sequence.LoadSequence(cfg.CwdPath, sequencePath)
 	if err != nil {
 		return nil, err
 	}
 
-	err = executionClient.Connect()
+	err = executionClient.Connect(ctx)
 	if err != nil {
 		return nil, err
 	}
@@ -113,11 +168,30 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 		maxConcurrentHosts = len(hostIdents)
 	}
 
-	// iterate the selected hosts
+	// the run wide timeout terminates whatever is executing on every host once it elapses, which includes connecting
+	ctx := context.Background()
+	if configObj.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, configObj.Timeout, cmdsession.NewTimeoutError(configObj.Timeout))
+		defer cancel()
+	}
+	ctx, release := trapInterrupts(ctx)
+	defer release()
+
+	// iterate the selected hosts, those which were not connected to when the run was cut short are left unconnected
 	executors := []*Executor{}
+	unconnected := []string{}
 	for _, hostIdent := range hostIdents {
-		e, err := NewExecutor(configObj, hostIdent, sequencePath)
+		if ctx.Err() != nil {
+			unconnected = append(unconnected, hostIdent)
+			continue
+		}
+		e, err := NewExecutor(ctx, configObj, hostIdent, sequencePath)
 		if err != nil {
+			if ctx.Err() != nil {
+				unconnected = append(unconnected, hostIdent)
+				continue
+			}
 			return nil, fmt.Errorf("unable to create executor\n%w", err)
 		}
 		defer func() {
@@ -141,6 +215,11 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 					// is incremented for every executor being enqueued (once per action in the case of sync)
 					defer execWaitGroup.Done()
 					for {
+						if ctx.Err() != nil {
+							// the run has been interrupted or timed out, no further actions are dispatched
+							break
+						}
+
 						action, err := e.ExecutionInstance.Next()
 						if err != nil {
 							e.ExecutionInstance.SetError(err)
@@ -159,7 +238,15 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 							e.ExecutionInstance.SetError(err)
 							log.Error([]any{"host", e.HostIdent}, "execution terminated due to error: %s", err.Error())
 						}
-						err = e.ExecutionInstance.Execute(action)
+						e.step = action.Description
+						err = e.ExecutionInstance.Execute(ctx, action)
+						if err != nil && ctx.Err() != nil {
+							// an interrupted or timed out run is not rescued, the host fails with the reason for it
+							err = context.Cause(ctx)
+						} else if err != nil && e.ExecutionInstance.Rescue(err) {
+							log.Error([]any{"host", e.HostIdent}, "action failed within a block, continuing with its rescue/always section: %s", err.Error())
+							err = nil
+						}
 						if syncExecutionSteps || err != nil {
 							if err != nil {
 								e.ExecutionInstance.SetError(err)
@@ -191,6 +278,10 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 		// non sync mode, a single loop will indicate completion of all hosts.
 		execWaitGroup.Wait()
 
+		if ctx.Err() != nil {
+			break
+		}
+
 		if syncExecutionSteps {
 			for _, e := range executors {
 				if e.ExecutionInstance.GetError() != nil {
@@ -202,6 +293,15 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 	}
 	close(execChan)
 
+	// hosts left with actions to execute when the run was cut short fail with the reason for it
+	if ctx.Err() != nil {
+		for _, e := range executors {
+			if e.ExecutionInstance.HasMore() {
+				e.ExecutionInstance.SetError(context.Cause(ctx))
+			}
+		}
+	}
+
 	valuesBytes, err := json.Marshal(configObj.ValuesStore.GetMapping())
 	if err != nil {
 		return nil, fmt.Errorf("unable to marshal values mapping to json: %w", err)
@@ -210,11 +310,40 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 		SuccessHosts: []string{},
 		FailHosts:    []*FailedHost{},
 		Values:       valuesBytes,
+		Stats:        map[string]*sequence.ActionStats{},
+	}
+	if configObj.Check {
+		resultObj.Plans = map[string][]*sequence.PlannedAction{}
+	}
+	interruption := context.Cause(ctx)
+	if !IsInterruptedError(interruption) {
+		interruption = nil
+	}
+	if interruption != nil {
+		resultObj.Interrupted = true
+		resultObj.Error = interruption.Error()
 	}
 	for _, e := range executors {
+		resultObj.Stats[e.HostIdent] = &e.ExecutionInstance.Stats
+		if configObj.Check {
+			resultObj.Plans[e.HostIdent] = e.ExecutionInstance.Plan
+		}
+		if len(e.ExecutionInstance.Messages) > 0 {
+			if resultObj.Messages == nil {
+				resultObj.Messages = map[string][]*sequence.DebugMessage{}
+			}
+			resultObj.Messages[e.HostIdent] = e.ExecutionInstance.Messages
+		}
+
 		if e.ExecutionInstance.GetError() != nil {
 			resultObj.FailCount++
-			fh := &FailedHost{Identity: e.HostIdent, Error: e.ExecutionInstance.GetError().Error()}
+			fh := &FailedHost{
+				Identity:    e.HostIdent,
+				Error:       e.ExecutionInstance.GetError().Error(),
+				TimedOut:    cmdsession.IsTimeoutError(e.ExecutionInstance.GetError()),
+				Interrupted: IsInterruptedError(e.ExecutionInstance.GetError()),
+				Step:        e.step,
+			}
 			if e.Config.Debug {
 				jBytes, err := json.Marshal(e.ExecutionInstance.ExecContext.GetMapping())
 				if err != nil {
@@ -229,6 +358,15 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 			resultObj.SuccessHosts = append(resultObj.SuccessHosts, e.HostIdent)
 		}
 	}
+	for _, hostIdent := range unconnected {
+		resultObj.FailCount++
+		resultObj.FailHosts = append(resultObj.FailHosts, &FailedHost{
+			Identity:    hostIdent,
+			Error:       context.Cause(ctx).Error(),
+			TimedOut:    cmdsession.IsTimeoutError(context.Cause(ctx)),
+			Interrupted: IsInterruptedError(context.Cause(ctx)),
+		})
+	}
 
 	duration := time.Since(start)
 	resultObj.Duration = float64(duration.Seconds())
@@ -238,8 +376,23 @@ func RunConcurrentExecutionGroup(sequencePath string, configObj *config.Config,
 	}
 
 	if !configObj.Json {
+		for _, e := range executors {
+			stats := e.ExecutionInstance.Stats
+			log.Info([]any{"host", e.HostIdent}, "ok=%d changed=%d skipped=%d failed=%d", stats.Ok, stats.Changed, stats.Skipped, stats.Failed)
+		}
 		log.Info(nil, "sequence completed in %s - %d successes and %d failures", duration.String(), resultObj.SuccessCount, resultObj.FailCount)
+		if configObj.Check {
+			log.Info(nil, "check mode was enabled, no actions were executed")
+		}
+		for _, fh := range resultObj.FailHosts {
+			if fh.Interrupted && fh.Step != "" {
+				log.Error([]any{"host", fh.Identity}, "interrupted at \"%s\"", fh.Step)
+			} else if fh.Interrupted {
+				log.Error([]any{"host", fh.Identity}, "interrupted before executing any action")
+			}
+		}
 	}
 
-	return resultObjBytes, nil
+	// the result is still returned when interrupted, so that partial results can be reported
+	return resultObjBytes, interruption
 }
@@ -0,0 +1,182 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/config"
+	"github.com/frozengoats/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+// localConfig produces a config which executes the sequence against the local machine, writing the sequence
+// to a file to be loaded in the same way as it would be from a recipe
+func localConfig(t *testing.T, sequenceYaml string) (*config.Config, string) {
+	dir := t.TempDir()
+	sequencePath := filepath.Join(dir, "sequence.yaml")
+	assert.NoError(t, os.WriteFile(sequencePath, []byte(sequenceYaml), 0o644))
+
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"local": {Host: "127.0.0.1"},
+		},
+		ValuesStore: kvstore.NewStore(),
+		CwdPath:     dir,
+		Json:        true,
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+	cfg.Executor.MaxConcurrentHosts = 1
+	return cfg, sequencePath
+}
+
+func TestInterruptReportsPartialResult(t *testing.T) {
+	cfg, sequencePath := localConfig(t, `
+sequence:
+  - description: first
+    shell: echo first
+  - description: wait
+    shell: sleep 5
+  - description: never
+    shell: echo never
+`)
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+
+	start := time.Now()
+	resultBytes, err := RunConcurrentExecutionGroup(sequencePath, cfg, []string{"local"})
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.True(t, IsInterruptedError(err))
+
+	result := &ResultObj{}
+	assert.NoError(t, json.Unmarshal(resultBytes, result))
+	assert.True(t, result.Interrupted)
+	assert.Equal(t, "interrupted by interrupt", result.Error)
+	assert.Len(t, result.FailHosts, 1)
+	assert.True(t, result.FailHosts[0].Interrupted)
+	assert.Equal(t, "wait", result.FailHosts[0].Step)
+	assert.Equal(t, 1, result.Stats["local"].Changed)
+}
+
+func TestRunTimeoutFailsHost(t *testing.T) {
+	cfg, sequencePath := localConfig(t, `
+sequence:
+  - description: wait
+    shell: sleep 5
+`)
+	cfg.Timeout = 200 * time.Millisecond
+
+	resultBytes, err := RunConcurrentExecutionGroup(sequencePath, cfg, []string{"local"})
+	assert.NoError(t, err)
+
+	result := &ResultObj{}
+	assert.NoError(t, json.Unmarshal(resultBytes, result))
+	assert.False(t, result.Interrupted)
+	assert.Len(t, result.FailHosts, 1)
+	assert.True(t, result.FailHosts[0].TimedOut)
+	assert.False(t, result.FailHosts[0].Interrupted)
+}
+
+func TestRunTimeoutSkipsRescue(t *testing.T) {
+	cfg, sequencePath := localConfig(t, `
+sequence:
+  - description: guarded
+    block:
+      - description: wait
+        shell: sleep 5
+    rescue:
+      - description: recover
+        shell: touch rescued
+`)
+	cfg.Timeout = 200 * time.Millisecond
+
+	resultBytes, err := RunConcurrentExecutionGroup(sequencePath, cfg, []string{"local"})
+	assert.NoError(t, err)
+
+	result := &ResultObj{}
+	assert.NoError(t, json.Unmarshal(resultBytes, result))
+	assert.Len(t, result.FailHosts, 1)
+	assert.True(t, result.FailHosts[0].TimedOut)
+	assert.Equal(t, "wait", result.FailHosts[0].Step)
+	assert.Equal(t, 0, result.Stats["local"].Rescued)
+	assert.NoFileExists(t, filepath.Join(cfg.CwdPath, "rescued"))
+}
+
+// hangingClient never completes connecting, as with an unresponsive host
+type hangingClient struct {
+	cmdsession.DummyExecutionClient
+}
+
+func (c *hangingClient) Connect(ctx context.Context) error {
+	<-ctx.Done()
+	return context.Cause(ctx)
+}
+
+func TestInterruptWhileConnectingReportsPartialResult(t *testing.T) {
+	cfg, sequencePath := localConfig(t, `
+sequence:
+  - description: greet
+    shell: echo hello
+`)
+	cfg.Hosts["unresponsive"] = &config.HostConfig{Host: "10.0.0.1"}
+	cfg.Hosts["other"] = &config.HostConfig{Host: "10.0.0.2"}
+
+	original := newExecutionClient
+	newExecutionClient = func(cfg *config.Config, hostIdent string, hostConfig *config.HostConfig) cmdsession.ExecutionClient {
+		if hostIdent == "local" {
+			return original(cfg, hostIdent, hostConfig)
+		}
+		return &hangingClient{}
+	}
+	defer func() {
+		newExecutionClient = original
+	}()
+
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		_ = syscall.Kill(os.Getpid(), syscall.SIGINT)
+	}()
+
+	start := time.Now()
+	resultBytes, err := RunConcurrentExecutionGroup(sequencePath, cfg, []string{"local", "unresponsive", "other"})
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.True(t, IsInterruptedError(err))
+
+	result := &ResultObj{}
+	assert.NoError(t, json.Unmarshal(resultBytes, result))
+	assert.True(t, result.Interrupted)
+	assert.Equal(t, 3, result.FailCount)
+	for _, fh := range result.FailHosts {
+		assert.True(t, fh.Interrupted, fh.Identity)
+		assert.Empty(t, fh.Step, fh.Identity)
+	}
+}
+
+func TestDebugMessagesInResult(t *testing.T) {
+	cfg, sequencePath := localConfig(t, `
+sequence:
+  - description: greet
+    debug:
+      message: hello from <!! .HostIdent !!>
+`)
+	cfg.Check = true
+
+	resultBytes, err := RunConcurrentExecutionGroup(sequencePath, cfg, []string{"local"})
+	assert.NoError(t, err)
+
+	result := &ResultObj{}
+	assert.NoError(t, json.Unmarshal(resultBytes, result))
+	assert.Equal(t, 0, result.FailCount)
+	assert.Len(t, result.Messages["local"], 1)
+	assert.Equal(t, "greet", result.Messages["local"][0].Description)
+	assert.Equal(t, "hello from local", result.Messages["local"][0].Message)
+}
@@ -1,6 +1,7 @@
 package log
 
 import (
+	"bytes"
 	"fmt"
 	"os"
 	"strings"
@@ -63,6 +64,45 @@ func Log(level int, context []any, formatString string, args ...any) {
 	_, _ = fmt.Fprintf(os.Stderr, "%s %5s - %s%s\n", now, levelToString(level), contextStr, logStr)
 }
 
+// LineWriter logs everything written to it, one line at a time, holding back any incomplete line until it is
+// completed or the writer is closed
+type LineWriter struct {
+	level   int
+	context []any
+	partial []byte
+}
+
+func NewLineWriter(level int, context []any) *LineWriter {
+	return &LineWriter{
+		level:   level,
+		context: context,
+	}
+}
+
+func (w *LineWriter) Write(p []byte) (int, error) {
+	w.partial = append(w.partial, p...)
+	for {
+		i := bytes.IndexByte(w.partial, '\n')
+		if i < 0 {
+			break
+		}
+		Log(w.level, w.context, "%s", strings.TrimSuffix(string(w.partial[:i]), "\r"))
+		w.partial = w.partial[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Close logs any remaining incomplete line
+func (w *LineWriter) Close() error {
+	if len(w.partial) > 0 {
+		Log(w.level, w.context, "%s", string(w.partial))
+		w.partial = nil
+	}
+
+	return nil
+}
+
 func Error(context []any, formatString string, args ...any) {
 	Log(ERROR, context, formatString, args...)
 }
@@ -0,0 +1,417 @@
+package sequence
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+)
+
+const (
+	archiveFormatTar   = "tar"
+	archiveFormatTarGz = "tar.gz"
+	archiveFormatZip   = "zip"
+
+	// the remote directory, within the home of whoever performs an unarchive action, holding a file per dest and archive
+	// which records the checksum of the archive last extracted there, so that the dest only holds what was extracted
+	unarchiveStateDir = "~/.crucible/unarchive"
+)
+
+// unarchiveMarker is the remote file which records the checksum of the archive of the given name last extracted to dest
+func unarchiveMarker(dest string, name string) string {
+	sum := sha256.Sum256([]byte(dest + "\x00" + name))
+	return path.Join(unarchiveStateDir, hex.EncodeToString(sum[:]))
+}
+
+// archiveFormat determines the format of an archive, from its name unless explicitly specified
+func archiveFormat(name string, format string) (string, error) {
+	if format != "" {
+		return format, validateArchiveFormat(format)
+	}
+
+	switch {
+	case strings.HasSuffix(name, ".tar"):
+		return archiveFormatTar, nil
+	case strings.HasSuffix(name, ".tar.gz"), strings.HasSuffix(name, ".tgz"):
+		return archiveFormatTarGz, nil
+	case strings.HasSuffix(name, ".zip"):
+		return archiveFormatZip, nil
+	default:
+		return "", fmt.Errorf("unable to determine the format of %s, a format is required", name)
+	}
+}
+
+func (u *Unarchive) validate() error {
+	if u.Src == "" || u.Dest == "" {
+		return fmt.Errorf("unarchive requires both a src and a dest")
+	}
+	if u.StripComponents < 0 {
+		return fmt.Errorf("stripComponents cannot be negative")
+	}
+
+	return validateArchiveFormat(u.Format)
+}
+
+func (a *Archive) validate() error {
+	if a.Src == "" || a.Dest == "" {
+		return fmt.Errorf("archive requires both a src and a dest")
+	}
+
+	return validateArchiveFormat(a.Format)
+}
+
+// validateArchiveFormat validates an explicitly specified format, since the name it is otherwise determined from may
+// only be known once templated
+func validateArchiveFormat(format string) error {
+	switch format {
+	case "", archiveFormatTar, archiveFormatTarGz, archiveFormatZip:
+		return nil
+	default:
+		return fmt.Errorf("format must be one of %s, %s or %s", archiveFormatTar, archiveFormatTarGz, archiveFormatZip)
+	}
+}
+
+// unarchive extracts a local archive, streamed over the existing connection, or an archive already on the remote host
+// into the remote dest.  it is only extracted when the creates path does not exist, or when no creates path is given,
+// when the sha256 sum of the archive differs from that recorded by the previous extraction to the dest.  local zip
+// archives are converted to tar as they are transferred, so that only tar is required on the remote host.  the sum of
+// the archive is stored on the immediate context as .checksum.
+func (ei *ExecutionInstance) unarchive(ctx context.Context, action *Action) (*actionResult, error) {
+	unarchiveAction := action.Unarchive
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	src, err := ei.renderString("unarchive src", unarchiveAction.Src)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := ei.renderString("unarchive dest", unarchiveAction.Dest)
+	if err != nil {
+		return nil, err
+	}
+	creates, err := ei.renderString("unarchive creates", unarchiveAction.Creates)
+	if err != nil {
+		return nil, err
+	}
+	format, err := archiveFormat(src, unarchiveAction.Format)
+	if err != nil {
+		return nil, err
+	}
+	if unarchiveAction.RemoteSrc && format == archiveFormatZip && unarchiveAction.StripComponents > 0 {
+		return nil, fmt.Errorf("stripComponents is not supported when extracting a remote zip archive")
+	}
+	if !unarchiveAction.RemoteSrc && !filepath.IsAbs(src) {
+		src = filepath.Join(ei.config.CwdPath, src)
+	}
+
+	execClient := ei.clientFor(action)
+	if creates != "" {
+		exists, err := ei.remoteExists(ctx, action, execClient, creates)
+		if err != nil {
+			return nil, err
+		}
+		if exists {
+			log.Info(logCtx, "%s exists, skipping extraction of %s", creates, src)
+			return &actionResult{}, nil
+		}
+	}
+
+	var checksum string
+	if unarchiveAction.RemoteSrc {
+		checksum, err = ei.remoteChecksum(ctx, action, src)
+	} else {
+		checksum, err = fileChecksum(src)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read unarchive src %s: %w", src, err)
+	}
+	err = ei.ExecContext.Set(checksum, ImmediateKey, "checksum")
+	if err != nil {
+		return nil, err
+	}
+
+	marker := unarchiveMarker(dest, path.Base(filepath.ToSlash(src)))
+	if creates == "" {
+		previous, _, err := ei.readRemoteFile(ctx, action, execClient, marker)
+		if err != nil {
+			return nil, err
+		}
+		if strings.TrimSpace(string(previous)) == checksum {
+			log.Info(logCtx, "%s has already been extracted to %s", src, dest)
+			return &actionResult{}, nil
+		}
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Src:  src,
+			Dest: dest,
+		})
+		log.Info(logCtx, "check mode, would extract %s to %s", src, dest)
+		return &actionResult{changed: true}, nil
+	}
+
+	archive := src
+	var stdin io.Reader
+	if !unarchiveAction.RemoteSrc {
+		archive = "-"
+		if format == archiveFormatZip {
+			converted := &bytes.Buffer{}
+			err = zipToTar(src, converted)
+			if err != nil {
+				return nil, fmt.Errorf("unable to convert %s to tar: %w", src, err)
+			}
+			format = archiveFormatTar
+			stdin = converted
+		} else {
+			f, err := os.Open(src)
+			if err != nil {
+				return nil, fmt.Errorf("unable to read unarchive src %s: %w", src, err)
+			}
+			defer func() {
+				_ = f.Close()
+			}()
+			stdin = f
+		}
+	}
+
+	result, err := ei.runRemoteScript(ctx, action, unarchiveScript, dest, stdin, format, archive, strconv.Itoa(unarchiveAction.StripComponents))
+	if err != nil {
+		return nil, fmt.Errorf("unable to extract %s: %w", src, err)
+	}
+	if result.exitCode != 0 {
+		return result, nil
+	}
+
+	if creates == "" {
+		markerResult, err := ei.runRemoteScript(ctx, action, makeDirScript, unarchiveStateDir, nil)
+		if err != nil {
+			return nil, err
+		}
+		if markerResult.exitCode == 0 {
+			markerResult, err = ei.writeRemoteFile(ctx, action, execClient, marker, []byte(checksum+"\n"))
+			if err != nil {
+				return nil, err
+			}
+		}
+		if markerResult.exitCode != 0 {
+			return nil, fmt.Errorf("unable to record extraction of %s: %w", src, cmdsession.NewExitCodeErrorWithStderr(markerResult.exitCode, markerResult.stderr))
+		}
+	}
+
+	log.Info(logCtx, "extracted %s to %s", src, dest)
+	result.changed = true
+	return result, nil
+}
+
+// archive archives a remote file or directory to a local archive, which is only written when its content differs from
+// that of the existing archive.  the remote host only ever produces a tar archive, which is compressed or converted to
+// zip locally.  the sha256 sum of the archive is stored on the immediate context as .checksum.
+func (ei *ExecutionInstance) archive(ctx context.Context, action *Action) (*actionResult, error) {
+	archiveAction := action.Archive
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	src, err := ei.renderString("archive src", archiveAction.Src)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := ei.renderString("archive dest", archiveAction.Dest)
+	if err != nil {
+		return nil, err
+	}
+	format, err := archiveFormat(dest, archiveAction.Format)
+	if err != nil {
+		return nil, err
+	}
+	if !filepath.IsAbs(dest) {
+		dest = filepath.Join(ei.config.CwdPath, dest)
+	}
+
+	result, err := ei.runRemoteScript(ctx, action, archiveScript, src, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to archive %s: %w", src, err)
+	}
+	if result.exitCode == missingFileExitCode {
+		return nil, fmt.Errorf("unable to archive %s, it does not exist", src)
+	}
+	if result.exitCode != 0 {
+		// the archive is of no use as output
+		return &actionResult{stderr: result.stderr, exitCode: result.exitCode}, nil
+	}
+
+	content := &bytes.Buffer{}
+	switch format {
+	case archiveFormatTar:
+		content.Write(result.stdout)
+	case archiveFormatTarGz:
+		// the gzip header carries no name or time, so that an unchanged src produces an identical archive
+		gw := gzip.NewWriter(content)
+		_, err = gw.Write(result.stdout)
+		if err == nil {
+			err = gw.Close()
+		}
+	case archiveFormatZip:
+		err = tarToZip(result.stdout, content)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to produce %s archive of %s: %w", format, src, err)
+	}
+
+	sum := sha256.Sum256(content.Bytes())
+	err = ei.ExecContext.Set(hex.EncodeToString(sum[:]), ImmediateKey, "checksum")
+	if err != nil {
+		return nil, err
+	}
+
+	current, err := os.ReadFile(dest)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if bytes.Equal(current, content.Bytes()) {
+		log.Info(logCtx, "archive of %s at %s is unchanged", src, dest)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Src:  src,
+			Dest: dest,
+		})
+		log.Info(logCtx, "check mode, would archive %s to %s", src, dest)
+		return &actionResult{changed: true}, nil
+	}
+
+	err = os.MkdirAll(filepath.Dir(dest), 0o755)
+	if err != nil {
+		return nil, err
+	}
+	err = os.WriteFile(dest, content.Bytes(), 0o644)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Info(logCtx, "archived %s to %s", src, dest)
+	return &actionResult{changed: true}, nil
+}
+
+// zipToTar writes the entries of a local zip archive to a tar stream
+func zipToTar(p string, w io.Writer) error {
+	zr, err := zip.OpenReader(p)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = zr.Close()
+	}()
+
+	tw := tar.NewWriter(w)
+	for _, f := range zr.File {
+		info := f.FileInfo()
+		hdr := &tar.Header{
+			Name:    f.Name,
+			Mode:    int64(info.Mode().Perm()),
+			ModTime: f.Modified,
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+		switch {
+		case info.IsDir():
+			hdr.Typeflag = tar.TypeDir
+			err = tw.WriteHeader(hdr)
+		case info.Mode()&fs.ModeSymlink != 0:
+			var target []byte
+			target, err = io.ReadAll(rc)
+			if err == nil {
+				hdr.Typeflag = tar.TypeSymlink
+				hdr.Linkname = string(target)
+				err = tw.WriteHeader(hdr)
+			}
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = int64(f.UncompressedSize64)
+			err = tw.WriteHeader(hdr)
+			if err == nil {
+				_, err = io.Copy(tw, rc)
+			}
+		}
+		_ = rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
+
+// tarToZip writes the entries of a tar archive to a zip archive
+func tarToZip(archive []byte, w io.Writer) error {
+	tr := tar.NewReader(bytes.NewReader(archive))
+	zw := zip.NewWriter(w)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		name := strings.TrimPrefix(hdr.Name, "./")
+		if name == "" {
+			continue
+		}
+
+		fh, err := zip.FileInfoHeader(hdr.FileInfo())
+		if err != nil {
+			return err
+		}
+		fh.Name = name
+		fh.Method = zip.Deflate
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			fh.Name = strings.TrimSuffix(name, "/") + "/"
+			fh.Method = zip.Store
+			_, err = zw.CreateHeader(fh)
+		case tar.TypeSymlink:
+			var fw io.Writer
+			fw, err = zw.CreateHeader(fh)
+			if err == nil {
+				_, err = io.WriteString(fw, hdr.Linkname)
+			}
+		case tar.TypeReg:
+			var fw io.Writer
+			fw, err = zw.CreateHeader(fh)
+			if err == nil {
+				_, err = io.Copy(fw, tr)
+			}
+		default:
+			return fmt.Errorf("archive contains unsupported entry %s", hdr.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return zw.Close()
+}
@@ -0,0 +1,145 @@
+package sequence
+
+import (
+	"archive/zip"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeZip writes a zip archive of the files, mapping names to contents, within a single top level directory
+func writeZip(t *testing.T, p string, files map[string]string) {
+	f, err := os.Create(p)
+	assert.NoError(t, err)
+	zw := zip.NewWriter(f)
+	for name, content := range files {
+		w, err := zw.Create("release/" + name)
+		assert.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, zw.Close())
+	assert.NoError(t, f.Close())
+}
+
+func TestArchiveRoundTrip(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "bundle")
+	local := t.TempDir()
+	dest := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "bin"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "bin", "app"), []byte("#!/bin/sh\n"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "app.conf"), []byte("port: 80\n"), 0o644))
+	assert.NoError(t, os.Symlink("app.conf", filepath.Join(src, "current.conf")))
+
+	for _, format := range []string{"bundle.tar", "bundle.tar.gz", "bundle.zip"} {
+		archive := &Action{
+			Description: "archive",
+			Archive: &Archive{
+				Src:  src,
+				Dest: format,
+			},
+		}
+		assert.NoError(t, archive.Validate())
+		exInst := syncInstance(t, archive)
+		exInst.config.CwdPath = local
+
+		assert.True(t, changed(t, exInst, archive))
+		assert.False(t, changed(t, exInst, archive))
+
+		unarchive := &Action{
+			Description: "unarchive",
+			Unarchive: &Unarchive{
+				Src:  format,
+				Dest: filepath.Join(dest, format),
+			},
+		}
+		assert.NoError(t, unarchive.Validate())
+		exInst = syncInstance(t, unarchive)
+		exInst.config.CwdPath = local
+
+		assert.True(t, changed(t, exInst, unarchive))
+		content, err := os.ReadFile(filepath.Join(dest, format, "bundle", "bin", "app"))
+		assert.NoError(t, err)
+		assert.Equal(t, "#!/bin/sh\n", string(content))
+		info, err := os.Stat(filepath.Join(dest, format, "bundle", "bin", "app"))
+		assert.NoError(t, err)
+		assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+		link, err := os.Readlink(filepath.Join(dest, format, "bundle", "current.conf"))
+		assert.NoError(t, err)
+		assert.Equal(t, "app.conf", link)
+
+		// the checksum recorded in the dest prevents a second extraction
+		assert.False(t, changed(t, exInst, unarchive))
+	}
+}
+
+func TestUnarchive(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	local := t.TempDir()
+	dest := filepath.Join(t.TempDir(), "app")
+	writeZip(t, filepath.Join(local, "release.zip"), map[string]string{"VERSION": "1\n"})
+
+	action := &Action{
+		Description: "unarchive",
+		Unarchive: &Unarchive{
+			Src:             "release.zip",
+			Dest:            dest,
+			StripComponents: 1,
+		},
+	}
+	exInst := syncInstance(t, action)
+	exInst.config.CwdPath = local
+
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	assert.NoDirExists(t, dest)
+
+	exInst.config.Check = false
+	assert.True(t, changed(t, exInst, action))
+	content, err := os.ReadFile(filepath.Join(dest, "VERSION"))
+	assert.NoError(t, err)
+	assert.Equal(t, "1\n", string(content))
+	assert.False(t, changed(t, exInst, action))
+
+	// the dest only holds what was extracted, the checksum of the archive being recorded elsewhere on the host
+	entries, err := os.ReadDir(dest)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.DirExists(t, filepath.Join(home, ".crucible", "unarchive"))
+
+	// a new release is extracted over the previous one
+	writeZip(t, filepath.Join(local, "release.zip"), map[string]string{"VERSION": "2\n"})
+	assert.True(t, changed(t, exInst, action))
+	content, err = os.ReadFile(filepath.Join(dest, "VERSION"))
+	assert.NoError(t, err)
+	assert.Equal(t, "2\n", string(content))
+
+	// an archive already on the host is extracted in place, unless the path it creates exists
+	remote := &Action{
+		Description: "unarchive",
+		Unarchive: &Unarchive{
+			Src:       filepath.Join(local, "release.zip"),
+			RemoteSrc: true,
+			Dest:      filepath.Join(t.TempDir(), "app"),
+			Creates:   dest + "/VERSION",
+		},
+	}
+	exInst = syncInstance(t, remote)
+	assert.False(t, changed(t, exInst, remote))
+	remote.Unarchive.Creates = remote.Unarchive.Dest + "/release/VERSION"
+	assert.True(t, changed(t, exInst, remote))
+	assert.FileExists(t, remote.Unarchive.Creates)
+	assert.False(t, changed(t, exInst, remote))
+
+	for _, invalid := range []*Unarchive{
+		{Src: "release.zip"},
+		{Src: "release.zip", Dest: dest, Format: "rar"},
+		{Src: "release.zip", Dest: dest, StripComponents: -1},
+	} {
+		assert.Error(t, (&Action{Unarchive: invalid}).Validate())
+	}
+	assert.Error(t, (&Action{Archive: &Archive{Src: "/var/log", Dest: "logs.tar.bz2", Format: "bz2"}}).Validate())
+}
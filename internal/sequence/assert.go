@@ -0,0 +1,90 @@
+package sequence
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/functions"
+	"github.com/frozengoats/crucible/internal/log"
+	"github.com/frozengoats/eval"
+)
+
+// assert evaluates every assertion, failing with the messages of all those which did not evaluate to true.  nothing is
+// executed on the host, so assertions are also evaluated in check mode.
+func (ei *ExecutionInstance) assert(action *Action) (*actionResult, error) {
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	var failures []string
+	for _, assertion := range action.Assert {
+		result, err := eval.Evaluate(assertion.Eval, ei.variableLookup, functions.Call)
+		if err != nil {
+			return nil, fmt.Errorf("unable to evaluate assertion %s: %w", assertion.Eval, err)
+		}
+		if eval.IsTruthy(result) {
+			continue
+		}
+
+		message := fmt.Sprintf("assertion failed: %s", assertion.Eval)
+		if assertion.Message != "" {
+			message, err = ei.renderString("assertion message", assertion.Message)
+			if err != nil {
+				return nil, err
+			}
+		}
+		failures = append(failures, message)
+	}
+
+	if len(failures) > 0 {
+		return nil, fmt.Errorf("%s", strings.Join(failures, "\n"))
+	}
+
+	log.Info(logCtx, "all %d assertion(s) passed", len(action.Assert))
+	return &actionResult{}, nil
+}
+
+// debug reports an evaluated expression, encoded as json unless it is a string, or a rendered message.  the message is
+// logged, stored on the immediate context as .message and included in the json output.
+func (ei *ExecutionInstance) debug(action *Action) (*actionResult, error) {
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	var message string
+	if action.Debug.Eval != "" {
+		result, err := eval.Evaluate(action.Debug.Eval, ei.variableLookup, functions.Call)
+		if err != nil {
+			return nil, fmt.Errorf("unable to evaluate debug expression %s: %w", action.Debug.Eval, err)
+		}
+
+		if s, ok := result.(string); ok {
+			message = s
+		} else {
+			encoded, err := json.Marshal(result)
+			if err != nil {
+				return nil, fmt.Errorf("unable to encode the result of debug expression %s: %w", action.Debug.Eval, err)
+			}
+			message = string(encoded)
+		}
+	} else {
+		var err error
+		message, err = ei.renderString("debug message", action.Debug.Message)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := ei.ExecContext.Set(message, ImmediateKey, "message")
+	if err != nil {
+		return nil, err
+	}
+
+	ei.Messages = append(ei.Messages, &DebugMessage{
+		Description: action.Description,
+		Message:     message,
+	})
+	log.Info(logCtx, "debug: %s", message)
+	return &actionResult{}, nil
+}
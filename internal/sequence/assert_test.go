@@ -0,0 +1,57 @@
+package sequence
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAssert(t *testing.T) {
+	action := &Action{
+		Description: "assert",
+		Assert: []*Assertion{
+			{Eval: ".Context.replicas > 1"},
+			{Eval: ".Context.env == production", Message: "<!! .Context.env !!> is not production"},
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.ExecContext.Set(3, "replicas"))
+	assert.NoError(t, exInst.ExecContext.Set("production", "env"))
+
+	assert.False(t, changed(t, exInst, action))
+
+	// every failed assertion is reported, in check mode as well
+	exInst.config.Check = true
+	assert.NoError(t, exInst.ExecContext.Set(1, "replicas"))
+	assert.NoError(t, exInst.ExecContext.Set("staging", "env"))
+	err := exInst.Execute(t.Context(), action)
+	assert.EqualError(t, err, "assertion failed: .Context.replicas > 1\nstaging is not production")
+
+	assert.Error(t, (&Action{Assert: []*Assertion{{Message: "no expression"}}}).Validate())
+}
+
+func TestDebug(t *testing.T) {
+	action := &Action{
+		Description: "show",
+		Debug: &Debug{
+			Eval: ".Context.ports",
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.ExecContext.Set([]any{80, 443}, "ports"))
+
+	assert.False(t, changed(t, exInst, action))
+	assert.Equal(t, "[80,443]", exInst.ExecContext.GetString(ImmediateKey, "message"))
+
+	action.Debug = &Debug{Message: "deploying to <!! .HostIdent !!>"}
+	assert.False(t, changed(t, exInst, action))
+	assert.Equal(t, []*DebugMessage{
+		{Description: "show", Message: "[80,443]"},
+		{Description: "show", Message: "deploying to testhost"},
+	}, exInst.Messages)
+
+	assert.Error(t, (&Action{Debug: &Debug{}}).Validate())
+	assert.Error(t, (&Action{Debug: &Debug{Eval: ".x", Message: "x"}}).Validate())
+}
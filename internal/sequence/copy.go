@@ -0,0 +1,195 @@
+package sequence
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+	"github.com/frozengoats/crucible/internal/utils"
+)
+
+func (c *Copy) validate() error {
+	// content is a pointer so that empty content, which writes an empty file, can be told apart from none
+	if (c.Src == "") == (c.Content == nil) {
+		return fmt.Errorf("exactly one of src or content must be specified")
+	}
+	if c.Dest == "" {
+		return fmt.Errorf("a dest is required")
+	}
+	if c.Content != nil && strings.HasSuffix(c.Dest, "/") {
+		return fmt.Errorf("dest must name the file when copying content")
+	}
+
+	_, _, err := c.Mode.parse()
+	return err
+}
+
+// copy writes a local file or inline content to a remote file, transferring it only when its sha256 sum differs from
+// that of the remote file, and then applies the mode and ownership.  unlike template, the src is copied verbatim.  the
+// sum of the content and the changes made are stored on the immediate context as .checksum and .changes.
+func (ei *ExecutionInstance) copy(ctx context.Context, action *Action) (*actionResult, error) {
+	copyAction := action.Copy
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	dest, err := ei.renderString("copy dest", copyAction.Dest)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := ei.renderString("copy owner", copyAction.Owner)
+	if err != nil {
+		return nil, err
+	}
+	group, err := ei.renderString("copy group", copyAction.Group)
+	if err != nil {
+		return nil, err
+	}
+	mode, hasMode, err := copyAction.Mode.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	var src string
+	var content []byte
+	if copyAction.Src != "" {
+		src, err = ei.renderString("copy src", copyAction.Src)
+		if err != nil {
+			return nil, err
+		}
+		if !filepath.IsAbs(src) {
+			src = filepath.Join(ei.config.CwdPath, src)
+		}
+		content, err = os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read copy src %s: %w", src, err)
+		}
+
+		// as with cp, a dest ending in a slash is the directory to copy into
+		if strings.HasSuffix(dest, "/") {
+			dest = path.Join(dest, filepath.Base(src))
+		}
+	} else {
+		rendered, err := ei.renderString("copy content", *copyAction.Content)
+		if err != nil {
+			return nil, err
+		}
+		content = []byte(rendered)
+	}
+
+	current, _, err := ei.statRemoteFile(ctx, action, dest, false)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && !current.isRegular() {
+		return nil, fmt.Errorf("%s exists and is a %s rather than a file", dest, current.kind)
+	}
+
+	sum := sha256.Sum256(content)
+	checksum := hex.EncodeToString(sum[:])
+	transfer := current == nil
+	if current != nil {
+		remoteChecksum, err := ei.remoteChecksum(ctx, action, dest)
+		if err != nil {
+			return nil, err
+		}
+		transfer = remoteChecksum != checksum
+	}
+
+	var changes []string
+	if transfer {
+		changes = append(changes, "write content")
+	}
+	// the attributes of an existing file survive it being rewritten
+	ownership, modeArg, attributeChanges := fileAttributes(current, nil, owner, group, mode, hasMode)
+	changes = append(changes, attributeChanges...)
+
+	err = ei.ExecContext.Set(checksum, ImmediateKey, "checksum")
+	if err != nil {
+		return nil, err
+	}
+	err = ei.ExecContext.Set(changes, ImmediateKey, "changes")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) == 0 {
+		log.Info(logCtx, "copy to %s is unchanged, skipping transfer", dest)
+		return &actionResult{}, nil
+	}
+
+	var diff string
+	if transfer && ei.config.Diff {
+		previous, _, err := ei.readRemoteFile(ctx, action, ei.clientFor(action), dest)
+		if err != nil {
+			return nil, err
+		}
+		diff, err = utils.UnifiedDiff(previous, content, dest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compute copy diff for %s: %w", dest, err)
+		}
+		log.Info(logCtx, "copy diff\n%s", diff)
+		err = ei.ExecContext.Set(diff, ImmediateKey, "diff")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Src:     src,
+			Dest:    dest,
+			Diff:    diff,
+			Changes: changes,
+		})
+		log.Info(logCtx, "check mode, would change %s: %s", dest, strings.Join(changes, ", "))
+		return &actionResult{changed: true}, nil
+	}
+
+	if transfer {
+		result, err := ei.writeRemoteFile(ctx, action, ei.clientFor(action), dest, content)
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	if ownership != "-" || modeArg != "-" {
+		result, err := ei.runRemoteScript(ctx, action, fileAttributesScript, dest, nil, ownership, modeArg, "-")
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	log.Info(logCtx, "changed %s: %s", dest, strings.Join(changes, ", "))
+	return &actionResult{changed: true}, nil
+}
+
+// remoteChecksum produces the sha256 sum of a remote file
+func (ei *ExecutionInstance) remoteChecksum(ctx context.Context, action *Action, p string) (string, error) {
+	return ei.remoteDigest(ctx, action, p, "sha256")
+}
+
+// remoteDigest produces the sum of a remote file using the algorithm, either sha256 or sha512
+func (ei *ExecutionInstance) remoteDigest(ctx context.Context, action *Action, p string, algorithm string) (string, error) {
+	result, err := ei.runRemoteScript(ctx, action, checksumScript, p, nil, algorithm)
+	if err != nil {
+		return "", err
+	}
+	if result.exitCode != 0 {
+		return "", fmt.Errorf("unable to checksum %s: %w", p, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+
+	fields := strings.Fields(string(result.stdout))
+	if len(fields) == 0 {
+		return "", fmt.Errorf("unable to checksum %s, no sum was produced", p)
+	}
+
+	return fields[0], nil
+}
@@ -0,0 +1,89 @@
+package sequence
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopySrc(t *testing.T) {
+	srcDir := t.TempDir()
+	dest := t.TempDir()
+	// literal braces are copied as is, rather than being treated as a template
+	assert.NoError(t, os.WriteFile(filepath.Join(srcDir, "values.yaml"), []byte("image: {{ .Values.image }}\n"), 0o644))
+
+	action := &Action{
+		Description: "copy",
+		Copy: &Copy{
+			Src:  "values.yaml",
+			Dest: dest + "/",
+			Mode: "0600",
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	exInst.config.CwdPath = srcDir
+
+	assert.True(t, changed(t, exInst, action))
+	content, err := os.ReadFile(filepath.Join(dest, "values.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, "image: {{ .Values.image }}\n", string(content))
+	info, err := os.Stat(filepath.Join(dest, "values.yaml"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	assert.False(t, changed(t, exInst, action))
+
+	// only the mode differs, so nothing is transferred
+	action.Copy.Mode = "0640"
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"mode 0600 -> 0640"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+}
+
+func TestCopyContent(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "motd")
+	content := "welcome to <!! .HostIdent !!>\n"
+	action := &Action{
+		Description: "copy",
+		Copy: &Copy{
+			Content: &content,
+			Dest:    dest,
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	written, err := os.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "welcome to testhost\n", string(written))
+	assert.False(t, changed(t, exInst, action))
+
+	assert.NoError(t, os.WriteFile(dest, []byte("tampered\n"), 0o644))
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	written, err = os.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "tampered\n", string(written))
+
+	// empty content truncates the file
+	empty := ""
+	action.Copy.Content = &empty
+	exInst.config.Check = false
+	assert.NoError(t, action.Validate())
+	assert.True(t, changed(t, exInst, action))
+	written, err = os.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Empty(t, written)
+	assert.False(t, changed(t, exInst, action))
+
+	for _, invalid := range []*Copy{
+		{Dest: dest},
+		{Src: "a", Content: &content, Dest: dest},
+		{Content: &content, Dest: "/tmp/"},
+		{Content: &content, Dest: dest, Mode: "rw"},
+	} {
+		assert.Error(t, (&Action{Copy: invalid}).Validate())
+	}
+}
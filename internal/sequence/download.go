@@ -0,0 +1,225 @@
+package sequence
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+)
+
+// parseChecksum splits a checksum of the form algorithm:hex, returning the algorithm and the lower case sum
+func parseChecksum(checksum string) (string, string, error) {
+	algorithm, sum, ok := strings.Cut(checksum, ":")
+	if !ok {
+		return "", "", fmt.Errorf("checksum must be of the form sha256:<hex> or sha512:<hex>")
+	}
+
+	var size int
+	switch algorithm {
+	case "sha256":
+		size = sha256.Size
+	case "sha512":
+		size = sha512.Size
+	default:
+		return "", "", fmt.Errorf("checksum algorithm must be one of sha256 or sha512")
+	}
+
+	sum = strings.ToLower(strings.TrimSpace(sum))
+	decoded, err := hex.DecodeString(sum)
+	if err != nil || len(decoded) != size {
+		return "", "", fmt.Errorf("%s checksum must be %d hex characters", algorithm, size*2)
+	}
+
+	return algorithm, sum, nil
+}
+
+func (d *Download) validate() error {
+	if d.Url == "" || d.Dest == "" {
+		return fmt.Errorf("download requires both a url and a dest")
+	}
+	if d.Checksum == "" {
+		return fmt.Errorf("a checksum is required")
+	}
+	// a templated checksum can only be checked once rendered
+	if !strings.Contains(d.Checksum, "<!!") {
+		if _, _, err := parseChecksum(d.Checksum); err != nil {
+			return err
+		}
+	}
+
+	_, _, err := d.Mode.parse()
+	return err
+}
+
+// download writes the content of a url to a remote file, verifying its checksum before it is put in place, and then
+// applies the mode and ownership.  nothing is downloaded when the remote file already has the expected checksum.  the
+// url is downloaded here and pushed over the existing connection, or with remote, downloaded on the host itself using
+// curl or wget.  the changes made are stored on the immediate context as .changes.
+func (ei *ExecutionInstance) download(ctx context.Context, action *Action) (*actionResult, error) {
+	downloadAction := action.Download
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	u, err := ei.renderString("download url", downloadAction.Url)
+	if err != nil {
+		return nil, err
+	}
+	dest, err := ei.renderString("download dest", downloadAction.Dest)
+	if err != nil {
+		return nil, err
+	}
+	checksum, err := ei.renderString("download checksum", downloadAction.Checksum)
+	if err != nil {
+		return nil, err
+	}
+	algorithm, sum, err := parseChecksum(checksum)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := ei.renderString("download owner", downloadAction.Owner)
+	if err != nil {
+		return nil, err
+	}
+	group, err := ei.renderString("download group", downloadAction.Group)
+	if err != nil {
+		return nil, err
+	}
+	mode, hasMode, err := downloadAction.Mode.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	// as with copy, a dest ending in a slash is the directory to download into
+	if strings.HasSuffix(dest, "/") {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, fmt.Errorf("unable to parse download url %s: %w", u, err)
+		}
+		name := path.Base(parsed.Path)
+		if name == "/" || name == "." {
+			return nil, fmt.Errorf("unable to determine a file name from %s, dest must name the file", u)
+		}
+		dest = path.Join(dest, name)
+	}
+
+	current, _, err := ei.statRemoteFile(ctx, action, dest, false)
+	if err != nil {
+		return nil, err
+	}
+	if current != nil && !current.isRegular() {
+		return nil, fmt.Errorf("%s exists and is a %s rather than a file", dest, current.kind)
+	}
+
+	transfer := current == nil
+	if current != nil {
+		remoteSum, err := ei.remoteDigest(ctx, action, dest, algorithm)
+		if err != nil {
+			return nil, err
+		}
+		transfer = remoteSum != sum
+	}
+
+	var changes []string
+	if transfer {
+		changes = append(changes, fmt.Sprintf("download %s", u))
+	}
+	ownership, modeArg, attributeChanges := fileAttributes(current, nil, owner, group, mode, hasMode)
+	changes = append(changes, attributeChanges...)
+
+	err = ei.ExecContext.Set(changes, ImmediateKey, "changes")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) == 0 {
+		log.Info(logCtx, "%s already has the expected checksum, skipping download", dest)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Src:     u,
+			Dest:    dest,
+			Changes: changes,
+		})
+		log.Info(logCtx, "check mode, would change %s: %s", dest, strings.Join(changes, ", "))
+		return &actionResult{changed: true}, nil
+	}
+
+	if transfer {
+		var result *actionResult
+		if downloadAction.Remote {
+			result, err = ei.runRemoteScript(ctx, action, downloadScript, dest, nil, u, algorithm, sum)
+		} else {
+			var content []byte
+			content, err = fetchUrl(ctx, u, algorithm, sum)
+			if err != nil {
+				return nil, err
+			}
+			result, err = ei.writeRemoteFile(ctx, action, ei.clientFor(action), dest, content)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("unable to download %s to %s: %w", u, dest, err)
+		}
+		if result.exitCode != 0 {
+			return nil, fmt.Errorf("unable to download %s to %s: %w", u, dest, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+		}
+	}
+
+	if ownership != "-" || modeArg != "-" {
+		result, err := ei.runRemoteScript(ctx, action, fileAttributesScript, dest, nil, ownership, modeArg, "-")
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	log.Info(logCtx, "changed %s: %s", dest, strings.Join(changes, ", "))
+	return &actionResult{changed: true}, nil
+}
+
+// fetchUrl downloads the content of a url from here, verifying that it has the expected sum
+func fetchUrl(ctx context.Context, u string, algorithm string, sum string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %w", u, err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %w", u, err)
+	}
+	defer func() {
+		_ = resp.Body.Close()
+	}()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unable to download %s, it returned a status of %d", u, resp.StatusCode)
+	}
+
+	var h hash.Hash
+	if algorithm == "sha512" {
+		h = sha512.New()
+	} else {
+		h = sha256.New()
+	}
+	content, err := io.ReadAll(io.TeeReader(resp.Body, h))
+	if err != nil {
+		return nil, fmt.Errorf("unable to download %s: %w", u, err)
+	}
+
+	downloaded := hex.EncodeToString(h.Sum(nil))
+	if downloaded != sum {
+		return nil, fmt.Errorf("checksum mismatch for %s, expected %s but downloaded %s", u, sum, downloaded)
+	}
+
+	return content, nil
+}
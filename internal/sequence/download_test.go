@@ -0,0 +1,114 @@
+package sequence
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDownload(t *testing.T) {
+	content := []byte("#!/bin/sh\necho kubectl\n")
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		if r.URL.Path != "/bin/kubectl" {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	sum := sha256.Sum256(content)
+	dest := t.TempDir()
+	action := &Action{
+		Description: "download",
+		Download: &Download{
+			Url:      server.URL + "/bin/kubectl",
+			Dest:     dest + "/",
+			Checksum: "sha256:" + hex.EncodeToString(sum[:]),
+			Mode:     "0755",
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	downloaded, err := os.ReadFile(filepath.Join(dest, "kubectl"))
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	info, err := os.Stat(filepath.Join(dest, "kubectl"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+
+	// a file with the expected checksum isn't downloaded again
+	assert.False(t, changed(t, exInst, action))
+	assert.Equal(t, int32(1), requests.Load())
+
+	// content which doesn't match the checksum is never written
+	assert.NoError(t, os.WriteFile(filepath.Join(dest, "kubectl"), []byte("old\n"), 0o755))
+	action.Download.Checksum = "sha256:" + hex.EncodeToString(make([]byte, sha256.Size))
+	assert.Error(t, exInst.Execute(t.Context(), action))
+	downloaded, err = os.ReadFile(filepath.Join(dest, "kubectl"))
+	assert.NoError(t, err)
+	assert.Equal(t, "old\n", string(downloaded))
+
+	action.Download.Url = server.URL + "/missing"
+	assert.Error(t, exInst.Execute(t.Context(), action))
+
+	for _, invalid := range []*Download{
+		{Url: server.URL, Dest: dest},
+		{Url: server.URL, Dest: dest, Checksum: "md5:d41d8cd98f00b204e9800998ecf8427e"},
+		{Url: server.URL, Dest: dest, Checksum: "sha256:abc"},
+		{Dest: dest, Checksum: action.Download.Checksum},
+	} {
+		assert.Error(t, (&Action{Download: invalid}).Validate())
+	}
+}
+
+func TestDownloadRemote(t *testing.T) {
+	content := []byte("helm\n")
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	}))
+	defer server.Close()
+
+	sum := sha512.Sum512(content)
+	dest := filepath.Join(t.TempDir(), "helm")
+	action := &Action{
+		Description: "download",
+		Download: &Download{
+			Url:      server.URL + "/helm",
+			Dest:     dest,
+			Checksum: "sha512:" + hex.EncodeToString(sum[:]),
+			Remote:   true,
+		},
+	}
+	exInst := syncInstance(t, action)
+
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	assert.NoFileExists(t, dest)
+
+	exInst.config.Check = false
+	assert.True(t, changed(t, exInst, action))
+	downloaded, err := os.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, content, downloaded)
+	assert.False(t, changed(t, exInst, action))
+
+	// a mismatched download is discarded on the host
+	assert.NoError(t, os.Remove(dest))
+	action.Download.Checksum = "sha512:" + hex.EncodeToString(make([]byte, sha512.Size))
+	assert.Error(t, exInst.Execute(t.Context(), action))
+	assert.NoFileExists(t, dest)
+	assert.NoFileExists(t, dest+".download")
+}
@@ -0,0 +1,258 @@
+package sequence
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/functions"
+	"github.com/frozengoats/crucible/internal/log"
+	"github.com/frozengoats/crucible/internal/render"
+)
+
+// fetch copies a remote file or directory to the local system, transferring only files whose sha256 sums differ from
+// their local counterparts.  as with sync, a src directory ending in a slash has its contents fetched into dest,
+// otherwise the directory itself is fetched into dest.  the paths fetched are stored on the immediate context as .files.
+func (ei *ExecutionInstance) fetch(ctx context.Context, action *Action) (*actionResult, error) {
+	fetchAction := action.Fetch
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	srcAny, err := render.Render(fetchAction.Src, ei.variableLookup, functions.Call)
+	if err != nil {
+		return nil, fmt.Errorf("unable to evaluate fetch src: %w", err)
+	}
+	src := render.ToString(srcAny)
+
+	destAny, err := render.Render(fetchAction.Dest, ei.variableLookup, functions.Call)
+	if err != nil {
+		return nil, fmt.Errorf("unable to evaluate fetch dest: %w", err)
+	}
+	dest := render.ToString(destAny)
+
+	if src == "" || dest == "" {
+		return nil, fmt.Errorf("fetch requires both a src and a dest")
+	}
+
+	if !filepath.IsAbs(dest) {
+		p, err := filepath.Abs(filepath.Join(ei.config.CwdPath, dest))
+		if err != nil {
+			return nil, fmt.Errorf("unable to transform fetch path %s to abs path: %w", dest, err)
+		}
+
+		if strings.HasSuffix(dest, "/") {
+			p += "/"
+		}
+		dest = p
+	}
+
+	root, prefix := src, ""
+	if !strings.HasSuffix(src, "/") {
+		root, prefix = path.Dir(src), path.Base(src)
+	}
+
+	remote, err := ei.remoteSyncManifest(ctx, action, root, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	top := remote["."]
+	if prefix != "" {
+		top = remote[prefix]
+	}
+	if top == nil || top.checksum == "" {
+		return nil, fmt.Errorf("unable to fetch %s, it does not exist or is not a regular file, directory or link", src)
+	}
+
+	// map each remote path to its local counterpart
+	targets := map[string]string{}
+	if top.checksum != dirChecksum {
+		target := dest
+		if info, err := os.Stat(dest); strings.HasSuffix(dest, "/") || (err == nil && info.IsDir()) {
+			target = filepath.Join(dest, prefix)
+		}
+		targets[prefix] = target
+	} else {
+		for name := range remote {
+			if name == "." {
+				continue
+			}
+			if !filepath.IsLocal(filepath.FromSlash(name)) {
+				return nil, fmt.Errorf("unable to fetch %s, remote path %s is outside of it", src, name)
+			}
+			targets[name] = filepath.Join(dest, filepath.FromSlash(name))
+		}
+	}
+
+	names := make([]string, 0, len(targets))
+	for name := range targets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var dirs, files []string
+	for _, name := range names {
+		r := remote[name]
+		if r.checksum == "" {
+			continue
+		}
+
+		current, err := localChecksum(targets[name])
+		if err != nil {
+			return nil, err
+		}
+		if current == r.checksum {
+			continue
+		}
+
+		if r.checksum == dirChecksum {
+			dirs = append(dirs, name)
+		} else {
+			files = append(files, name)
+		}
+	}
+
+	err = ei.ExecContext.Set(files, ImmediateKey, "files")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dirs) == 0 && len(files) == 0 {
+		log.Info(logCtx, "fetch of %s to %s is unchanged, skipping transfer", src, dest)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Src:   src,
+			Dest:  dest,
+			Files: files,
+		})
+		log.Info(logCtx, "check mode, would fetch %s to %s%s", src, dest, syncReport(files, nil, 0))
+		return &actionResult{changed: true}, nil
+	}
+
+	if top.checksum == dirChecksum {
+		err = os.MkdirAll(dest, 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range dirs {
+		err = os.MkdirAll(targets[name], 0o755)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if len(files) > 0 {
+		cmd, err := ei.privileged(action, []string{ei.config.Executor.ShellBinary, "-c", fetchArchiveScript, root})
+		if err != nil {
+			return nil, err
+		}
+
+		result, err := ei.executeRemoteCommand(ctx, ei.executionClient, strings.NewReader(strings.Join(files, "\n")+"\n"), cmd)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch %s: %w", src, err)
+		}
+		if result.exitCode != 0 {
+			// the archive is of no use as output
+			return &actionResult{stderr: result.stderr, exitCode: result.exitCode}, nil
+		}
+
+		err = extractFetchArchive(result.stdout, targets)
+		if err != nil {
+			return nil, fmt.Errorf("unable to fetch %s: %w", src, err)
+		}
+	}
+
+	log.Info(logCtx, "fetched %s to %s%s", src, dest, syncReport(files, nil, 0))
+	return &actionResult{changed: true}, nil
+}
+
+// localChecksum produces the checksum of a local path in the same form as the remote manifest, or an empty string if
+// the path does not exist
+func localChecksum(p string) (string, error) {
+	info, err := os.Lstat(p)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", err
+	}
+
+	switch {
+	case info.Mode()&fs.ModeSymlink != 0:
+		link, err := os.Readlink(p)
+		if err != nil {
+			return "", err
+		}
+		return "link:" + link, nil
+	case info.IsDir():
+		return dirChecksum, nil
+	case info.Mode().IsRegular():
+		return fileChecksum(p)
+	default:
+		return "", nil
+	}
+}
+
+// extractFetchArchive writes the files and links in the archive to their local targets
+func extractFetchArchive(archive []byte, targets map[string]string) error {
+	tr := tar.NewReader(bytes.NewReader(archive))
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		target, ok := targets[strings.TrimPrefix(hdr.Name, "./")]
+		if !ok {
+			return fmt.Errorf("archive contains unexpected path %s", hdr.Name)
+		}
+
+		err = os.MkdirAll(filepath.Dir(target), 0o755)
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeReg:
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(f, tr)
+			_ = f.Close()
+			if err != nil {
+				return err
+			}
+
+			// an existing file retains its mode when opened, so it is set explicitly
+			err = os.Chmod(target, hdr.FileInfo().Mode().Perm())
+			if err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			_ = os.Remove(target)
+			err = os.Symlink(hdr.Linkname, target)
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("archive contains unsupported entry %s", hdr.Name)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package sequence
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFetchDirectory(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "logs")
+	assert.NoError(t, os.MkdirAll(filepath.Join(remote, "nested"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(remote, "app.log"), []byte("app\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(remote, "nested", "binary.bin"), []byte{0, 1, 2, 255}, 0o600))
+
+	action := &Action{
+		Description: "fetch",
+		Fetch: &Fetch{
+			Src:  remote,
+			Dest: "fetched/<!! .HostIdent !!>/",
+		},
+	}
+	exInst := syncInstance(t, action)
+	exInst.config.CwdPath = t.TempDir()
+	local := filepath.Join(exInst.config.CwdPath, "fetched", "testhost", "logs")
+
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"logs/app.log", "logs/nested/binary.bin"}, exInst.ExecContext.Get(ImmediateKey, "files"))
+	content, err := os.ReadFile(filepath.Join(local, "nested", "binary.bin"))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 255}, content)
+
+	assert.False(t, changed(t, exInst, action))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(remote, "app.log"), []byte("app\nmore\n"), 0o644))
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"logs/app.log"}, exInst.ExecContext.Get(ImmediateKey, "files"))
+	content, err = os.ReadFile(filepath.Join(local, "app.log"))
+	assert.NoError(t, err)
+	assert.Equal(t, "app\nmore\n", string(content))
+}
+
+func TestFetchFile(t *testing.T) {
+	remote := filepath.Join(t.TempDir(), "kubeconfig")
+	assert.NoError(t, os.WriteFile(remote, []byte("config\n"), 0o600))
+	local := filepath.Join(t.TempDir(), "testhost.kubeconfig")
+
+	action := &Action{
+		Description: "fetch",
+		Fetch: &Fetch{
+			Src:  remote,
+			Dest: local,
+		},
+	}
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	content, err := os.ReadFile(local)
+	assert.NoError(t, err)
+	assert.Equal(t, "config\n", string(content))
+	assert.False(t, changed(t, exInst, action))
+
+	action.Fetch.Src = filepath.Join(filepath.Dir(remote), "missing")
+	assert.Error(t, exInst.Execute(context.Background(), action))
+}
@@ -0,0 +1,319 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+)
+
+const (
+	fileStateFile      = "file"
+	fileStateDirectory = "directory"
+	fileStateLink      = "link"
+	fileStateTouch     = "touch"
+	fileStateAbsent    = "absent"
+)
+
+// remoteFile is the state of a remote path as reported by fileStatScript
+type remoteFile struct {
+	kind  string
+	mode  uint32
+	owner string
+	group string
+	uid   string
+	gid   string
+	link  string
+}
+
+func (f *remoteFile) isDir() bool {
+	return f.kind == "directory"
+}
+
+func (f *remoteFile) isLink() bool {
+	return f.kind == "symbolic link"
+}
+
+func (f *remoteFile) isRegular() bool {
+	return strings.HasPrefix(f.kind, "regular")
+}
+
+// ownedBy indicates whether the owner and group, which are either names or ids, match those of the file
+func (f *remoteFile) ownedBy(owner string, group string) bool {
+	return (owner == "" || owner == f.owner || owner == f.uid) && (group == "" || group == f.group || group == f.gid)
+}
+
+func (f *File) validate() error {
+	switch f.State {
+	case "", fileStateFile, fileStateDirectory, fileStateTouch, fileStateAbsent:
+		if f.Src != "" {
+			return fmt.Errorf("src can only be specified for a link")
+		}
+	case fileStateLink:
+		if f.Src == "" {
+			return fmt.Errorf("a link requires a src")
+		}
+	default:
+		return fmt.Errorf("state must be one of %s, %s, %s, %s or %s", fileStateFile, fileStateDirectory, fileStateLink, fileStateTouch, fileStateAbsent)
+	}
+
+	if f.Path == "" {
+		return fmt.Errorf("a path is required")
+	}
+	if f.Recurse && f.State != fileStateDirectory {
+		return fmt.Errorf("recurse can only be specified for a directory")
+	}
+	if f.State == fileStateLink && f.Mode != "" {
+		return fmt.Errorf("a link has no mode of its own")
+	}
+	if f.State == fileStateAbsent && (f.Mode != "" || f.Owner != "" || f.Group != "") {
+		return fmt.Errorf("mode, owner and group cannot be specified for an absent path")
+	}
+
+	_, _, err := f.Mode.parse()
+	return err
+}
+
+// file brings a remote path to the desired state, having first inspected it so that only what differs is changed.
+// the changes made are stored on the immediate context as .changes.
+func (ei *ExecutionInstance) file(ctx context.Context, action *Action) (*actionResult, error) {
+	fileAction := action.File
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	p, err := ei.renderString("file path", fileAction.Path)
+	if err != nil {
+		return nil, err
+	}
+	src, err := ei.renderString("file src", fileAction.Src)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := ei.renderString("file owner", fileAction.Owner)
+	if err != nil {
+		return nil, err
+	}
+	group, err := ei.renderString("file group", fileAction.Group)
+	if err != nil {
+		return nil, err
+	}
+	mode, hasMode, err := fileAction.Mode.parse()
+	if err != nil {
+		return nil, err
+	}
+
+	state := fileAction.State
+	if state == "" {
+		state = fileStateFile
+	}
+
+	current, tree, err := ei.statRemoteFile(ctx, action, p, fileAction.Recurse)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	var script string
+	var args []string
+	switch state {
+	case fileStateAbsent:
+		if current != nil {
+			changes = append(changes, "remove")
+			script = removeScript
+		}
+	case fileStateFile:
+		if current == nil {
+			return nil, fmt.Errorf("file %s does not exist", p)
+		}
+		if !current.isRegular() {
+			return nil, fmt.Errorf("%s exists and is a %s rather than a file", p, current.kind)
+		}
+	case fileStateTouch:
+		if current == nil {
+			changes = append(changes, "create file")
+			script = touchScript
+		}
+	case fileStateDirectory:
+		if current == nil {
+			changes = append(changes, "create directory")
+			script = makeDirScript
+		} else if !current.isDir() {
+			return nil, fmt.Errorf("%s exists and is a %s rather than a directory", p, current.kind)
+		}
+	case fileStateLink:
+		if current != nil && current.isDir() {
+			return nil, fmt.Errorf("%s exists and is a directory rather than a link", p)
+		}
+		if current == nil || !current.isLink() || current.link != src {
+			changes = append(changes, fmt.Sprintf("link to %s", src))
+			script = linkScript
+			args = []string{src}
+		}
+	}
+
+	existing := current
+	if script != "" {
+		existing = nil
+	}
+	ownership, modeArg, attributeChanges := fileAttributes(existing, tree, owner, group, mode, hasMode)
+	changes = append(changes, attributeChanges...)
+	recurse := "-"
+	if fileAction.Recurse {
+		recurse = "-R"
+	}
+
+	err = ei.ExecContext.Set(changes, ImmediateKey, "changes")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) == 0 {
+		log.Info(logCtx, "%s is unchanged", p)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Dest:    p,
+			Changes: changes,
+		})
+		log.Info(logCtx, "check mode, would change %s: %s", p, strings.Join(changes, ", "))
+		return &actionResult{changed: true}, nil
+	}
+
+	if script != "" {
+		result, err := ei.runRemoteScript(ctx, action, script, p, nil, args...)
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	if ownership != "-" || modeArg != "-" {
+		result, err := ei.runRemoteScript(ctx, action, fileAttributesScript, p, nil, ownership, modeArg, recurse)
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	log.Info(logCtx, "changed %s: %s", p, strings.Join(changes, ", "))
+	return &actionResult{changed: true}, nil
+}
+
+// fileAttributes determines the ownership and mode arguments of fileAttributesScript needed to bring the path, and
+// everything within it, in line with the owner, group and mode, along with a description of the changes.  a nil
+// current indicates that the path is being created, so its attributes can't be known and are always applied.
+func fileAttributes(current *remoteFile, tree []*remoteFile, owner string, group string, mode uint32, hasMode bool) (string, string, []string) {
+	var changes []string
+
+	ownership := "-"
+	if owner != "" || group != "" {
+		if current == nil || !current.ownedBy(owner, group) || !treeOwnedBy(tree, owner, group) {
+			ownership = owner
+			if group != "" {
+				ownership += ":" + group
+			}
+			changes = append(changes, fmt.Sprintf("ownership %s", ownership))
+		}
+	}
+
+	modeArg := "-"
+	if hasMode {
+		if current == nil || current.mode != mode || !treeHasMode(tree, mode) {
+			modeArg = fmt.Sprintf("%04o", mode)
+			if current != nil && current.mode != mode {
+				changes = append(changes, fmt.Sprintf("mode %04o -> %s", current.mode, modeArg))
+			} else {
+				changes = append(changes, fmt.Sprintf("mode %s", modeArg))
+			}
+		}
+	}
+
+	return ownership, modeArg, changes
+}
+
+// statRemoteFile describes the remote path, which is nil if it does not exist, along with everything within it when
+// recursing into a directory
+func (ei *ExecutionInstance) statRemoteFile(ctx context.Context, action *Action, p string, recurse bool) (*remoteFile, []*remoteFile, error) {
+	arg := "-"
+	if recurse {
+		arg = "-R"
+	}
+
+	result, err := ei.runRemoteScript(ctx, action, fileStatScript, p, nil, arg)
+	if err != nil {
+		return nil, nil, err
+	}
+	if result.exitCode == missingFileExitCode {
+		return nil, nil, nil
+	}
+	if result.exitCode != 0 {
+		return nil, nil, fmt.Errorf("unable to inspect %s: %w", p, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+
+	lines := strings.Split(strings.TrimRight(string(result.stdout), "\n"), "\n")
+	current, err := parseFileStat(lines[0])
+	if err != nil {
+		return nil, nil, err
+	}
+	if current.isLink() {
+		if len(lines) > 1 {
+			current.link = lines[1]
+		}
+		return current, nil, nil
+	}
+
+	var tree []*remoteFile
+	for _, line := range lines[1:] {
+		f, err := parseFileStat(line)
+		if err != nil {
+			return nil, nil, err
+		}
+		tree = append(tree, f)
+	}
+
+	return current, tree, nil
+}
+
+// parseFileStat parses a type|mode|user|group|uid|gid line of fileStatScript
+func parseFileStat(line string) (*remoteFile, error) {
+	parts := strings.Split(line, "|")
+	if len(parts) != 6 {
+		return nil, fmt.Errorf("unexpected file description: %s", line)
+	}
+
+	mode, err := strconv.ParseUint(parts[1], 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected file mode: %s", parts[1])
+	}
+
+	return &remoteFile{
+		kind:  parts[0],
+		mode:  uint32(mode),
+		owner: parts[2],
+		group: parts[3],
+		uid:   parts[4],
+		gid:   parts[5],
+	}, nil
+}
+
+func treeOwnedBy(tree []*remoteFile, owner string, group string) bool {
+	for _, f := range tree {
+		if !f.ownedBy(owner, group) {
+			return false
+		}
+	}
+	return true
+}
+
+func treeHasMode(tree []*remoteFile, mode uint32) bool {
+	for _, f := range tree {
+		if f.mode != mode {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,106 @@
+package sequence
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/goccy/go-yaml"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFileDirectory(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "app", "data")
+	action := &Action{
+		Description: "directory",
+		File:        &File{Path: dir, State: "directory", Mode: "0750"},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	info, err := os.Stat(dir)
+	assert.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.Equal(t, os.FileMode(0o750), info.Mode().Perm())
+	assert.False(t, changed(t, exInst, action))
+
+	action.File.Mode = "0755"
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"mode 0750 -> 0755"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+
+	// everything within the directory is brought in line when recursing
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "file.txt"), []byte("file\n"), 0o600))
+	action.File = &File{Path: dir, State: "directory", Owner: "nobody", Group: "0", Mode: "0755", Recurse: true}
+	assert.True(t, changed(t, exInst, action))
+	info, err = os.Stat(filepath.Join(dir, "file.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+	assert.NotEqual(t, uint32(0), info.Sys().(*syscall.Stat_t).Uid)
+	assert.False(t, changed(t, exInst, action))
+}
+
+func TestFileLinkTouchAndAbsent(t *testing.T) {
+	dir := t.TempDir()
+	link := filepath.Join(dir, "current")
+	action := &Action{
+		Description: "link",
+		File:        &File{Path: link, State: "link", Src: "releases/1"},
+	}
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	target, err := os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, "releases/1", target)
+	assert.False(t, changed(t, exInst, action))
+
+	action.File.Src = "releases/2"
+	assert.True(t, changed(t, exInst, action))
+	target, err = os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, "releases/2", target)
+
+	touched := filepath.Join(dir, "touched")
+	action.File = &File{Path: touched, State: "touch"}
+	assert.True(t, changed(t, exInst, action))
+	assert.FileExists(t, touched)
+	assert.False(t, changed(t, exInst, action))
+
+	// a file which is expected to exist is not created
+	action.File = &File{Path: filepath.Join(dir, "missing"), Mode: "0644"}
+	assert.Error(t, exInst.Execute(context.Background(), action))
+
+	action.File = &File{Path: touched, State: "absent"}
+	assert.True(t, changed(t, exInst, action))
+	assert.NoFileExists(t, touched)
+	assert.False(t, changed(t, exInst, action))
+
+	exInst.config.Check = true
+	action.File = &File{Path: dir, State: "absent"}
+	assert.True(t, changed(t, exInst, action))
+	assert.DirExists(t, dir)
+	assert.Len(t, exInst.Plan, 1)
+}
+
+func TestFileValidation(t *testing.T) {
+	f := &File{}
+	assert.NoError(t, yaml.Unmarshal([]byte("path: /tmp\nmode: 0755\n"), f))
+	assert.Equal(t, Mode("0755"), f.Mode)
+	assert.NoError(t, yaml.Unmarshal([]byte("path: /tmp\nmode: '0644'\n"), f))
+	assert.Equal(t, Mode("0644"), f.Mode)
+
+	for _, invalid := range []*File{
+		{},
+		{Path: "/tmp", State: "link"},
+		{Path: "/tmp", Src: "/opt"},
+		{Path: "/tmp", State: "socket"},
+		{Path: "/tmp", Mode: "0999"},
+		{Path: "/tmp", Recurse: true},
+		{Path: "/tmp", State: "absent", Owner: "root"},
+	} {
+		assert.Error(t, (&Action{File: invalid}).Validate())
+	}
+}
@@ -0,0 +1,326 @@
+package sequence
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+	"github.com/frozengoats/crucible/internal/utils"
+)
+
+const (
+	editStatePresent = "present"
+	editStateAbsent  = "absent"
+
+	defaultBlockMarker = "# {mark} CRUCIBLE MANAGED BLOCK"
+	backupTimeFormat   = "20060102T150405"
+)
+
+// validateEdit validates the properties shared by lineInFile and blockInFile
+func validateEdit(p string, state string, insertAfter string, insertBefore string) error {
+	if p == "" {
+		return fmt.Errorf("a path is required")
+	}
+
+	switch state {
+	case "", editStatePresent, editStateAbsent:
+	default:
+		return fmt.Errorf("state must be one of %s or %s", editStatePresent, editStateAbsent)
+	}
+
+	if insertAfter != "" && insertBefore != "" {
+		return fmt.Errorf("insertAfter and insertBefore are mutually exclusive")
+	}
+
+	return nil
+}
+
+func (l *LineInFile) validate() error {
+	err := validateEdit(l.Path, l.State, l.InsertAfter, l.InsertBefore)
+	if err != nil {
+		return err
+	}
+
+	if l.State == editStateAbsent {
+		if l.Line == "" && l.Regex == "" {
+			return fmt.Errorf("a line or regex is required to remove lines")
+		}
+	} else if l.Line == "" {
+		return fmt.Errorf("a line is required")
+	}
+
+	if strings.Contains(l.Line, "\n") {
+		return fmt.Errorf("line cannot span multiple lines, use blockInFile instead")
+	}
+
+	return nil
+}
+
+func (b *BlockInFile) validate() error {
+	err := validateEdit(b.Path, b.State, b.InsertAfter, b.InsertBefore)
+	if err != nil {
+		return err
+	}
+
+	if b.Marker != "" && !strings.Contains(b.Marker, "{mark}") {
+		return fmt.Errorf("marker must contain {mark}")
+	}
+
+	return nil
+}
+
+// lineInFile ensures that a line is present in a remote file, replacing the last line matching the regex if there is
+// one, or that every line matching the regex (or equal to the line) is absent
+func (ei *ExecutionInstance) lineInFile(ctx context.Context, action *Action) (*actionResult, error) {
+	lineAction := action.LineInFile
+
+	p, err := ei.renderString("lineInFile path", lineAction.Path)
+	if err != nil {
+		return nil, err
+	}
+	line, err := ei.renderString("lineInFile line", lineAction.Line)
+	if err != nil {
+		return nil, err
+	}
+	re, err := ei.renderRegex("lineInFile regex", lineAction.Regex)
+	if err != nil {
+		return nil, err
+	}
+	after, before, err := ei.renderInsertion("lineInFile", lineAction.InsertAfter, lineAction.InsertBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	matches := func(l string) bool {
+		if re != nil {
+			return re.MatchString(l)
+		}
+		return l == line
+	}
+
+	return ei.editRemoteFile(ctx, action, p, lineAction.Create, lineAction.Backup, func(lines []string) []string {
+		if lineAction.State == editStateAbsent {
+			var kept []string
+			for _, l := range lines {
+				if !matches(l) {
+					kept = append(kept, l)
+				}
+			}
+			return kept
+		}
+
+		for i := len(lines) - 1; i >= 0; i-- {
+			if matches(lines[i]) {
+				edited := append([]string{}, lines...)
+				edited[i] = line
+				return edited
+			}
+		}
+		for _, l := range lines {
+			if l == line {
+				return lines
+			}
+		}
+
+		return insertLines(lines, []string{line}, after, before)
+	})
+}
+
+// blockInFile ensures that a block of lines surrounded by marker lines is present in, or absent from, a remote file.
+// the markers identify the block on subsequent runs, allowing its content to be replaced.
+func (ei *ExecutionInstance) blockInFile(ctx context.Context, action *Action) (*actionResult, error) {
+	blockAction := action.BlockInFile
+
+	p, err := ei.renderString("blockInFile path", blockAction.Path)
+	if err != nil {
+		return nil, err
+	}
+	block, err := ei.renderString("blockInFile block", blockAction.Block)
+	if err != nil {
+		return nil, err
+	}
+	after, before, err := ei.renderInsertion("blockInFile", blockAction.InsertAfter, blockAction.InsertBefore)
+	if err != nil {
+		return nil, err
+	}
+
+	marker := blockAction.Marker
+	if marker == "" {
+		marker = defaultBlockMarker
+	}
+	begin := strings.ReplaceAll(marker, "{mark}", "BEGIN")
+	end := strings.ReplaceAll(marker, "{mark}", "END")
+
+	desired := []string{begin}
+	if block != "" {
+		desired = append(desired, strings.Split(strings.TrimSuffix(block, "\n"), "\n")...)
+	}
+	desired = append(desired, end)
+
+	return ei.editRemoteFile(ctx, action, p, blockAction.Create, blockAction.Backup, func(lines []string) []string {
+		start, finish := -1, -1
+		for i, l := range lines {
+			if l == begin && start < 0 {
+				start = i
+			} else if l == end && start >= 0 {
+				finish = i
+				break
+			}
+		}
+
+		if start < 0 || finish < 0 {
+			if blockAction.State == editStateAbsent {
+				return lines
+			}
+			return insertLines(lines, desired, after, before)
+		}
+
+		edited := append([]string{}, lines[:start]...)
+		if blockAction.State != editStateAbsent {
+			edited = append(edited, desired...)
+		}
+		return append(edited, lines[finish+1:]...)
+	})
+}
+
+// renderRegex renders and compiles a templated regular expression, which is nil when there is none
+func (ei *ExecutionInstance) renderRegex(what string, value string) (*regexp.Regexp, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	expr, err := ei.renderString(what, value)
+	if err != nil {
+		return nil, err
+	}
+
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return nil, fmt.Errorf("unable to compile %s %s: %w", what, expr, err)
+	}
+
+	return re, nil
+}
+
+// renderInsertion renders the insertAfter and insertBefore regular expressions of an edit
+func (ei *ExecutionInstance) renderInsertion(what string, insertAfter string, insertBefore string) (*regexp.Regexp, *regexp.Regexp, error) {
+	after, err := ei.renderRegex(what+" insertAfter", insertAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	before, err := ei.renderRegex(what+" insertBefore", insertBefore)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return after, before, nil
+}
+
+// insertLines inserts the new lines after the last line matching after, or before the last line matching before,
+// falling back to the end of the file when neither is given or matches
+func insertLines(lines []string, inserted []string, after *regexp.Regexp, before *regexp.Regexp) []string {
+	at := len(lines)
+	for i := len(lines) - 1; i >= 0; i-- {
+		if after != nil && after.MatchString(lines[i]) {
+			at = i + 1
+			break
+		}
+		if before != nil && before.MatchString(lines[i]) {
+			at = i
+			break
+		}
+	}
+
+	edited := append([]string{}, lines[:at]...)
+	edited = append(edited, inserted...)
+	return append(edited, lines[at:]...)
+}
+
+// editRemoteFile applies the edit to the lines of a remote file, writing the file back only if the edit changed it
+func (ei *ExecutionInstance) editRemoteFile(ctx context.Context, action *Action, p string, create bool, backup bool, edit func([]string) []string) (*actionResult, error) {
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	execClient := ei.clientFor(action)
+	current, exists, err := ei.readRemoteFile(ctx, action, execClient, p)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines []string
+	if len(current) > 0 {
+		lines = strings.Split(strings.TrimSuffix(string(current), "\n"), "\n")
+	}
+	edited := edit(lines)
+
+	// lines are compared rather than content, so that a missing newline at the end of the file isn't a change.  a
+	// missing file is left as such when there's nothing to put in it.
+	if slices.Equal(lines, edited) {
+		log.Info(logCtx, "%s is unchanged", p)
+		return &actionResult{}, nil
+	}
+
+	if !exists && !create {
+		return nil, fmt.Errorf("file %s does not exist", p)
+	}
+
+	var updated []byte
+	if len(edited) > 0 {
+		updated = []byte(strings.Join(edited, "\n") + "\n")
+	}
+
+	var diff string
+	if ei.config.Diff {
+		diff, err = utils.UnifiedDiff(current, updated, p)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compute diff for %s: %w", p, err)
+		}
+		log.Info(logCtx, "diff\n%s", diff)
+		err = ei.ExecContext.Set(diff, ImmediateKey, "diff")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Dest:    p,
+			Content: string(updated),
+			Diff:    diff,
+		})
+		log.Info(logCtx, "check mode, would edit %s", p)
+		return &actionResult{changed: true}, nil
+	}
+
+	if exists && backup {
+		suffix := time.Now().Format(backupTimeFormat)
+		result, err := ei.runRemoteScript(ctx, action, backupScript, p, nil, suffix)
+		if err != nil {
+			return nil, err
+		}
+		if result.exitCode != 0 {
+			return nil, fmt.Errorf("unable to back up %s: %w", p, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+		}
+
+		err = ei.ExecContext.Set(p+"."+suffix, ImmediateKey, "backup")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	result, err := ei.runRemoteScript(ctx, action, replaceFileScript, p, bytes.NewReader(updated))
+	if err != nil {
+		return nil, err
+	}
+	result.changed = result.exitCode == 0
+	log.Info(logCtx, "edited %s", p)
+	return result, nil
+}
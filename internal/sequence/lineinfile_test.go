@@ -0,0 +1,140 @@
+package sequence
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLineInFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "sshd_config")
+	assert.NoError(t, os.WriteFile(p, []byte("Port 22\n#PermitRootLogin yes\nUsePAM yes\n"), 0o600))
+	original, err := os.Stat(p)
+	assert.NoError(t, err)
+
+	action := &Action{
+		Description: "disable root login",
+		LineInFile: &LineInFile{
+			Path:   p,
+			Line:   "PermitRootLogin <!! .Context.login !!>",
+			Regex:  "^#?PermitRootLogin",
+			Backup: true,
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.ExecContext.Set("no", "login"))
+
+	assert.True(t, changed(t, exInst, action))
+	content, err := os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "Port 22\nPermitRootLogin no\nUsePAM yes\n", string(content))
+	backup, err := os.ReadFile(exInst.ExecContext.GetString(ImmediateKey, "backup"))
+	assert.NoError(t, err)
+	assert.Equal(t, "Port 22\n#PermitRootLogin yes\nUsePAM yes\n", string(backup))
+	info, err := os.Stat(p)
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o600), info.Mode().Perm())
+	// the file is replaced rather than rewritten in place, so it is never seen partially written
+	assert.False(t, os.SameFile(original, info))
+	assert.NoFileExists(t, p+".crucible-tmp")
+
+	assert.False(t, changed(t, exInst, action))
+
+	// a link is left in place, with the file it links to being edited
+	link := filepath.Join(t.TempDir(), "sshd_config")
+	assert.NoError(t, os.Symlink(p, link))
+	action.LineInFile = &LineInFile{Path: link, Line: "PermitRootLogin yes", Regex: "^PermitRootLogin"}
+	assert.True(t, changed(t, exInst, action))
+	target, err := os.Readlink(link)
+	assert.NoError(t, err)
+	assert.Equal(t, p, target)
+	content, err = os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "Port 22\nPermitRootLogin yes\nUsePAM yes\n", string(content))
+	action.LineInFile = &LineInFile{Path: p, Line: "PermitRootLogin no", Regex: "^PermitRootLogin"}
+	assert.True(t, changed(t, exInst, action))
+
+	// new lines are inserted relative to the last matching line
+	action.LineInFile = &LineInFile{Path: p, Line: "AllowUsers deploy", InsertAfter: "^Port"}
+	assert.True(t, changed(t, exInst, action))
+	action.LineInFile = &LineInFile{Path: p, Line: "Include /etc/ssh/sshd_config.d/*.conf", InsertBefore: "^Port"}
+	assert.True(t, changed(t, exInst, action))
+	content, err = os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "Include /etc/ssh/sshd_config.d/*.conf\nPort 22\nAllowUsers deploy\nPermitRootLogin no\nUsePAM yes\n", string(content))
+
+	action.LineInFile = &LineInFile{Path: p, Regex: "^(Allow|Include)", State: "absent"}
+	assert.True(t, changed(t, exInst, action))
+	content, err = os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "Port 22\nPermitRootLogin no\nUsePAM yes\n", string(content))
+
+	// a missing file is only created when asked to be
+	missing := filepath.Join(t.TempDir(), "hosts")
+	action.LineInFile = &LineInFile{Path: missing, Line: "10.0.0.1 db"}
+	assert.Error(t, exInst.Execute(context.Background(), action))
+	action.LineInFile.Create = true
+	assert.True(t, changed(t, exInst, action))
+	content, err = os.ReadFile(missing)
+	assert.NoError(t, err)
+	assert.Equal(t, "10.0.0.1 db\n", string(content))
+}
+
+func TestBlockInFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "hosts")
+	assert.NoError(t, os.WriteFile(p, []byte("127.0.0.1 localhost"), 0o644))
+
+	action := &Action{
+		Description: "hosts",
+		BlockInFile: &BlockInFile{
+			Path:  p,
+			Block: "10.0.0.1 db\n10.0.0.2 cache\n",
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	content, err := os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n# BEGIN CRUCIBLE MANAGED BLOCK\n10.0.0.1 db\n10.0.0.2 cache\n# END CRUCIBLE MANAGED BLOCK\n", string(content))
+	assert.False(t, changed(t, exInst, action))
+
+	action.BlockInFile.Block = "10.0.0.3 db"
+	assert.True(t, changed(t, exInst, action))
+	content, err = os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n# BEGIN CRUCIBLE MANAGED BLOCK\n10.0.0.3 db\n# END CRUCIBLE MANAGED BLOCK\n", string(content))
+
+	action.BlockInFile.State = "absent"
+	assert.True(t, changed(t, exInst, action))
+	content, err = os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n", string(content))
+	assert.False(t, changed(t, exInst, action))
+
+	for _, invalid := range []*Action{
+		{LineInFile: &LineInFile{Path: p}},
+		{LineInFile: &LineInFile{Path: p, Line: "a", InsertAfter: "x", InsertBefore: "y"}},
+		{LineInFile: &LineInFile{Path: p, Line: "a\nb"}},
+		{BlockInFile: &BlockInFile{Path: p, Marker: "# managed"}},
+		{BlockInFile: &BlockInFile{Block: "a"}},
+	} {
+		assert.Error(t, invalid.Validate())
+	}
+}
+
+func TestLineInFileAbsentFromMissingFile(t *testing.T) {
+	missing := filepath.Join(t.TempDir(), "missing")
+	action := &Action{
+		Description: "absent",
+		LineInFile:  &LineInFile{Path: missing, Regex: "^x", State: "absent"},
+	}
+	exInst := syncInstance(t, action)
+	assert.False(t, changed(t, exInst, action))
+	assert.NoFileExists(t, missing)
+}
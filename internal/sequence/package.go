@@ -0,0 +1,328 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+)
+
+const (
+	packageStatePresent = "present"
+	packageStateAbsent  = "absent"
+	packageStateLatest  = "latest"
+)
+
+// packageDetectScript prints the name of the first package manager found on the host
+const packageDetectScript = `for m in apt-get dnf yum apk zypper; do
+	if command -v $m >/dev/null 2>&1; then echo $m; exit 0; fi
+done
+exit 1`
+
+// packageQueryScript prints name|version|upgradable for each package named in its arguments, where $0 is the package
+// manager and $1 is "latest" when upgrades should be looked for.  the version is empty for a package which is not
+// installed, and upgradable is 1 if a newer version is available.
+const packageQueryScript = `m="$0"; l="$1"; shift
+for n in "$@"; do
+	v=""; u=""
+	case "$m" in
+	apt-get)
+		v=$(dpkg-query -W -f="\${Status} \${Version}" "$n" 2>/dev/null | sed -n "s/^install ok installed //p")
+		if [ "$l" = latest ] && [ -n "$v" ]; then
+			c=$(apt-cache policy "$n" 2>/dev/null | sed -n "s/^ *Candidate: //p")
+			if [ -n "$c" ] && [ "$c" != "(none)" ] && [ "$c" != "$v" ]; then u=1; fi
+		fi;;
+	dnf|yum)
+		v=$(rpm -q --qf "%{VERSION}-%{RELEASE}" "$n" 2>/dev/null) || v=""
+		if [ "$l" = latest ] && [ -n "$v" ]; then
+			"$m" -q check-update "$n" >/dev/null 2>&1
+			if [ $? -eq 100 ]; then u=1; fi
+		fi;;
+	zypper)
+		v=$(rpm -q --qf "%{VERSION}-%{RELEASE}" "$n" 2>/dev/null) || v=""
+		if [ "$l" = latest ] && [ -n "$v" ]; then
+			if zypper -n -q list-updates 2>/dev/null | grep -q "| $n "; then u=1; fi
+		fi;;
+	apk)
+		v=$(apk list --installed "$n" 2>/dev/null | head -n 1 | cut -d " " -f 1)
+		if [ -n "$v" ]; then v="${v#"$n"-}"; fi
+		if [ "$l" = latest ] && [ -n "$v" ] && [ -n "$(apk list --upgradable "$n" 2>/dev/null)" ]; then u=1; fi;;
+	esac
+	printf "%s|%s|%s\n" "$n" "$v" "$u"
+done`
+
+// packageManager holds the commands used to drive a package manager, each of which is followed by package names
+type packageManager struct {
+	update  []string
+	install []string
+	upgrade []string
+	remove  []string
+	pin     string // separates a package name from the version to install
+}
+
+var packageManagers = map[string]*packageManager{
+	"apt-get": {
+		update:  []string{"apt-get", "update", "-q"},
+		install: []string{"env", "DEBIAN_FRONTEND=noninteractive", "apt-get", "install", "-y", "-q", "--allow-downgrades"},
+		upgrade: []string{"env", "DEBIAN_FRONTEND=noninteractive", "apt-get", "install", "-y", "-q", "--only-upgrade"},
+		remove:  []string{"env", "DEBIAN_FRONTEND=noninteractive", "apt-get", "remove", "-y", "-q"},
+		pin:     "=",
+	},
+	"dnf": {
+		update:  []string{"dnf", "makecache", "-q"},
+		install: []string{"dnf", "install", "-y", "-q"},
+		upgrade: []string{"dnf", "upgrade", "-y", "-q"},
+		remove:  []string{"dnf", "remove", "-y", "-q"},
+		pin:     "-",
+	},
+	"yum": {
+		update:  []string{"yum", "makecache", "-q"},
+		install: []string{"yum", "install", "-y", "-q"},
+		upgrade: []string{"yum", "update", "-y", "-q"},
+		remove:  []string{"yum", "remove", "-y", "-q"},
+		pin:     "-",
+	},
+	"apk": {
+		update:  []string{"apk", "update", "-q"},
+		install: []string{"apk", "add", "-q"},
+		upgrade: []string{"apk", "add", "-q", "-u"},
+		remove:  []string{"apk", "del", "-q"},
+		pin:     "=",
+	},
+	"zypper": {
+		update:  []string{"zypper", "-n", "-q", "refresh"},
+		install: []string{"zypper", "-n", "-q", "install"},
+		upgrade: []string{"zypper", "-n", "-q", "update"},
+		remove:  []string{"zypper", "-n", "-q", "remove"},
+		pin:     "=",
+	},
+}
+
+// installedPackage is the state of a package as reported by packageQueryScript
+type installedPackage struct {
+	version    string
+	upgradable bool
+}
+
+func (p *Package) validate() error {
+	switch p.State {
+	case "", packageStatePresent, packageStateAbsent, packageStateLatest:
+	default:
+		return fmt.Errorf("state must be one of %s, %s or %s", packageStatePresent, packageStateAbsent, packageStateLatest)
+	}
+
+	if p.Name != "" && len(p.Names) > 0 {
+		return fmt.Errorf("name and names are mutually exclusive")
+	}
+	if p.Name == "" && len(p.Names) == 0 {
+		return fmt.Errorf("a name or names are required")
+	}
+	if p.Version != "" {
+		if p.Name == "" {
+			return fmt.Errorf("a version can only be specified for a single package")
+		}
+		if p.State != "" && p.State != packageStatePresent {
+			return fmt.Errorf("a version can only be specified for a present package")
+		}
+	}
+
+	return nil
+}
+
+// versionMatches indicates whether an installed version satisfies the requested one, which may omit the release or
+// revision suffix added by the distribution
+func versionMatches(installed string, version string) bool {
+	return installed == version || strings.HasPrefix(installed, version+"-")
+}
+
+// pkg brings packages to the desired state using the package manager of the host, having first queried them so that
+// the package manager is only invoked for those which differ.  the changes made are stored on the immediate context as
+// .changes and the package manager in use as .manager.
+func (ei *ExecutionInstance) pkg(ctx context.Context, action *Action) (*actionResult, error) {
+	packageAction := action.Package
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	names := append([]string{}, packageAction.Names...)
+	if packageAction.Name != "" {
+		names = []string{packageAction.Name}
+	}
+	for i, name := range names {
+		rendered, err := ei.renderString("package name", name)
+		if err != nil {
+			return nil, err
+		}
+		if rendered == "" {
+			return nil, fmt.Errorf("package name %s evaluates to an empty string", name)
+		}
+		names[i] = rendered
+	}
+	version, err := ei.renderString("package version", packageAction.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	state := packageAction.State
+	if state == "" {
+		state = packageStatePresent
+	}
+
+	manager, err := ei.detectPackageManager(ctx, action)
+	if err != nil {
+		return nil, err
+	}
+	err = ei.ExecContext.Set(manager, ImmediateKey, "manager")
+	if err != nil {
+		return nil, err
+	}
+	commands := packageManagers[manager]
+
+	// refreshing the package index changes nothing which is managed, so it is neither reported as a change nor
+	// skipped when the packages are already in the desired state, but it is skipped in check mode
+	if packageAction.UpdateCache && !ei.config.Check {
+		result, err := ei.runPackageManager(ctx, action, commands.update, nil)
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	installed, err := ei.queryPackages(ctx, action, manager, names, state == packageStateLatest)
+	if err != nil {
+		return nil, err
+	}
+
+	var install, upgrade, remove, changes []string
+	for _, name := range names {
+		current := installed[name]
+		switch {
+		case state == packageStateAbsent:
+			if current.version != "" {
+				remove = append(remove, name)
+				changes = append(changes, fmt.Sprintf("remove %s", name))
+			}
+		case current.version == "":
+			if version != "" {
+				install = append(install, name+commands.pin+version)
+				changes = append(changes, fmt.Sprintf("install %s %s", name, version))
+			} else {
+				install = append(install, name)
+				changes = append(changes, fmt.Sprintf("install %s", name))
+			}
+		case version != "" && !versionMatches(current.version, version):
+			install = append(install, name+commands.pin+version)
+			changes = append(changes, fmt.Sprintf("install %s %s -> %s", name, current.version, version))
+		case state == packageStateLatest && current.upgradable:
+			upgrade = append(upgrade, name)
+			changes = append(changes, fmt.Sprintf("upgrade %s", name))
+		}
+	}
+
+	err = ei.ExecContext.Set(changes, ImmediateKey, "changes")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) == 0 {
+		log.Info(logCtx, "packages %s are unchanged", strings.Join(names, ", "))
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Changes: changes,
+		})
+		log.Info(logCtx, "check mode, would change packages using %s: %s", manager, strings.Join(changes, ", "))
+		return &actionResult{changed: true}, nil
+	}
+
+	var result *actionResult
+	for _, step := range []struct {
+		cmd      []string
+		packages []string
+	}{
+		{commands.remove, remove},
+		{commands.install, install},
+		{commands.upgrade, upgrade},
+	} {
+		if len(step.packages) == 0 {
+			continue
+		}
+
+		result, err = ei.runPackageManager(ctx, action, step.cmd, step.packages)
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	log.Info(logCtx, "changed packages using %s: %s", manager, strings.Join(changes, ", "))
+	result.changed = true
+	return result, nil
+}
+
+// detectPackageManager determines which of the supported package managers is available on the host
+func (ei *ExecutionInstance) detectPackageManager(ctx context.Context, action *Action) (string, error) {
+	result, err := ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, []string{ei.config.Executor.ShellBinary, "-c", packageDetectScript})
+	if err != nil {
+		return "", fmt.Errorf("unable to detect package manager: %w", err)
+	}
+	if result.exitCode != 0 {
+		return "", fmt.Errorf("no supported package manager was found, one of apt-get, dnf, yum, apk or zypper is required")
+	}
+
+	manager := strings.TrimSpace(string(result.stdout))
+	if packageManagers[manager] == nil {
+		return "", fmt.Errorf("unexpected package manager %s", manager)
+	}
+
+	return manager, nil
+}
+
+// queryPackages describes the installed state of each package, looking for available upgrades if requested
+func (ei *ExecutionInstance) queryPackages(ctx context.Context, action *Action, manager string, names []string, latest bool) (map[string]*installedPackage, error) {
+	arg := "-"
+	if latest {
+		arg = packageStateLatest
+	}
+
+	cmd := append([]string{ei.config.Executor.ShellBinary, "-c", packageQueryScript, manager, arg}, names...)
+	result, err := ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to query packages: %w", err)
+	}
+	if result.exitCode != 0 {
+		return nil, fmt.Errorf("unable to query packages: %w", cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+
+	installed := map[string]*installedPackage{}
+	for _, line := range strings.Split(strings.TrimSpace(string(result.stdout)), "\n") {
+		parts := strings.Split(line, "|")
+		if len(parts) != 3 {
+			return nil, fmt.Errorf("unexpected package description: %s", line)
+		}
+		installed[parts[0]] = &installedPackage{
+			version:    parts[1],
+			upgradable: parts[2] == "1",
+		}
+	}
+
+	for _, name := range names {
+		if installed[name] == nil {
+			return nil, fmt.Errorf("package %s is missing from the query result", name)
+		}
+	}
+
+	return installed, nil
+}
+
+// runPackageManager runs a package manager command with the packages appended, with output streamed if requested
+func (ei *ExecutionInstance) runPackageManager(ctx context.Context, action *Action, command []string, packages []string) (*actionResult, error) {
+	cmd, err := ei.privileged(action, append(append([]string{}, command...), packages...))
+	if err != nil {
+		return nil, err
+	}
+
+	return ei.executeCommand(ctx, ei.clientFor(action), nil, cmd, action.Stream || ei.config.Stream)
+}
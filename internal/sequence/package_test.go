@@ -0,0 +1,153 @@
+package sequence
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeApk is a stand-in for apk which records its invocations in a log and the installed packages in a database, one
+// name-version per line, where any version below 2.0 can be upgraded to 2.0-r0
+const fakeApk = `#!/bin/sh
+db=%[1]s/installed
+echo "$@" >> %[1]s/log
+case "$1" in
+list)
+	if [ "$2" = --installed ]; then
+		grep "^$3-[0-9]" "$db" | sed "s/$/ x86_64 {$3} (MIT) [installed]/"
+	elif grep -q "^$3-1\." "$db"; then
+		echo "$3-2.0-r0 x86_64 {$3} (MIT) [upgradable from: $(grep "^$3-" "$db")]"
+	fi;;
+add)
+	shift; u=""
+	for a in "$@"; do
+		case "$a" in
+		-u) u=1;;
+		-*) ;;
+		*=*) n="${a%%%%=*}"; sed -i "/^$n-[0-9]/d" "$db"; echo "$n-${a#*=}-r0" >> "$db";;
+		*) if [ -n "$u" ]; then sed -i "/^$a-[0-9]/d" "$db"; echo "$a-2.0-r0" >> "$db"; else echo "$a-1.0-r0" >> "$db"; fi;;
+		esac
+	done;;
+del)
+	shift
+	for a in "$@"; do
+		case "$a" in
+		-*) ;;
+		*) sed -i "/^$a-[0-9]/d" "$db";;
+		esac
+	done;;
+esac
+`
+
+// packageHost restricts the PATH to a directory holding the fake apk and the tools the package scripts require, so that
+// apk is the only package manager to be found
+func packageHost(t *testing.T) (string, func() []string) {
+	dir := t.TempDir()
+	for _, tool := range []string{"sh", "sed", "grep", "head", "cut"} {
+		p, err := exec.LookPath(tool)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Symlink(p, filepath.Join(dir, tool)))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "apk"), []byte(fmt.Sprintf(fakeApk, dir)), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "installed"), nil, 0o644))
+	t.Setenv("PATH", dir)
+
+	// the package manager commands which modified packages, ignoring queries
+	invocations := func() []string {
+		content, err := os.ReadFile(filepath.Join(dir, "log"))
+		assert.NoError(t, err)
+		var modified []string
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			if !strings.HasPrefix(line, "list") {
+				modified = append(modified, line)
+			}
+		}
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "log"), nil, 0o644))
+		return modified
+	}
+
+	return dir, invocations
+}
+
+func TestPackage(t *testing.T) {
+	dir, invocations := packageHost(t)
+
+	action := &Action{
+		Description: "package",
+		Package: &Package{
+			Names:       []string{"curl", "<!! .Context.tool !!>"},
+			UpdateCache: true,
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.ExecContext.Set("jq", "tool"))
+
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, "apk", exInst.ExecContext.GetString(ImmediateKey, "manager"))
+	assert.Equal(t, []any{"install curl", "install jq"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+	assert.Equal(t, []string{"update -q", "add -q curl jq"}, invocations())
+
+	// the cache is still updated, but nothing is installed
+	assert.False(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"update -q"}, invocations())
+
+	action.Package.State = packageStateLatest
+	action.Package.UpdateCache = false
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"add -q -u curl jq"}, invocations())
+	assert.False(t, changed(t, exInst, action))
+
+	action.Package.State = packageStateAbsent
+	action.Package.Names = []string{"curl", "wget"}
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"remove curl"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+	assert.Equal(t, []string{"del -q curl"}, invocations())
+
+	content, err := os.ReadFile(filepath.Join(dir, "installed"))
+	assert.NoError(t, err)
+	assert.Equal(t, "jq-2.0-r0\n", string(content))
+}
+
+func TestPackageVersion(t *testing.T) {
+	_, invocations := packageHost(t)
+
+	action := &Action{
+		Description: "package",
+		Package: &Package{
+			Name:    "nginx",
+			Version: "1.24",
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"install nginx 1.24"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+	assert.Empty(t, invocations())
+
+	exInst.config.Check = false
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"add -q nginx=1.24"}, invocations())
+	assert.False(t, changed(t, exInst, action))
+
+	action.Package.Version = "1.26"
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"install nginx 1.24-r0 -> 1.26"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+
+	for _, invalid := range []*Package{
+		{},
+		{Name: "a", Names: []string{"b"}},
+		{Names: []string{"a", "b"}, Version: "1.0"},
+		{Name: "a", Version: "1.0", State: packageStateLatest},
+		{Name: "a", State: "installed"},
+	} {
+		assert.Error(t, (&Action{Package: invalid}).Validate())
+	}
+}
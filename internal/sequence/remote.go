@@ -0,0 +1,136 @@
+package sequence
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+)
+
+// remote paths are passed to scripts as $0, leaving them free of any quoting concerns.  since arguments are not
+// always subject to tilde expansion by the time they reach the script, a leading tilde is expanded to $HOME here.
+const expandPath = `p="$0"; case "$p" in "~") p="$HOME";; "~/"*) p="$HOME/${p#"~/"}";; esac; `
+
+const (
+	missingFileExitCode = 100
+
+	readFileScript  = expandPath + `[ -e "$p" ] || exit 100; exec cat "$p"`
+	chdirScript     = expandPath + `cd "$p" && exec "$@"`
+	writeFileScript = expandPath + `exec cat > "$p"`
+
+	// lists the sha256 sum of every file, the target of every link, every directory and the mode and ownership of
+	// everything beneath the given path, limited to the names passed as additional arguments when provided
+	syncManifestScript = expandPath + `cd "$p" 2>/dev/null || exit 0; [ $# -gt 0 ] || set -- .; ` +
+		`find "$@" -type f -exec sha256sum {} + 2>/dev/null; ` +
+		`find "$@" -type d 2>/dev/null | while IFS= read -r f; do printf "dir  %s\n" "$f"; done; ` +
+		`find "$@" -type l 2>/dev/null | while IFS= read -r f; do printf "link:%s  %s\n" "$(readlink "$f")" "$f"; done; ` +
+		`find "$@" -exec stat -c "attr:%a:%U:%G  %n" {} + 2>/dev/null; exit 0`
+	// ownership is never restored from the archive, being applied afterwards only when it is to be preserved
+	syncExtractScript = expandPath + `mkdir -p "$p" && exec tar -xof - -C "$p"`
+	// reads lines of mode|owner|path from stdin, where a dash indicates that the attribute is left as is
+	syncAttributesScript = expandPath + `cd "$p" || exit 1; while IFS="|" read -r m o f; do ` +
+		`if [ "$o" != "-" ]; then chown -h "$o" "$f" || exit 1; fi; ` +
+		`if [ "$m" != "-" ]; then chmod "$m" "$f" || exit 1; fi; done`
+	// reads lines of paths to remove from stdin
+	syncDeleteScript = expandPath + `cd "$p" || exit 0; while IFS= read -r f; do rm -rf -- "$f" || exit 1; done`
+	isDirScript      = expandPath + `[ -d "$p" ]`
+	existsScript     = expandPath + `[ -e "$p" ] || [ -L "$p" ]`
+
+	// describes the path as type|mode|user|group|uid|gid, followed by the target of a link, or by the same for
+	// everything within a directory (other than links) when passed -R
+	fileStatScript = expandPath + `[ -e "$p" ] || [ -L "$p" ] || exit 100; stat -c "%F|%a|%U|%G|%u|%g" "$p" || exit 1; ` +
+		`if [ -L "$p" ]; then readlink "$p"; elif [ "$1" = "-R" ] && [ -d "$p" ]; then ` +
+		`find "$p" -mindepth 1 ! -type l -exec stat -c "%F|%a|%U|%G|%u|%g" {} + || exit 1; fi`
+	// takes the algorithm, sha256 or sha512
+	checksumScript = expandPath + `exec "${1}sum" < "$p"`
+	backupScript   = expandPath + `exec cp -p -- "$p" "$p.$1"`
+	makeDirScript  = expandPath + `exec mkdir -p -- "$p"`
+	touchScript    = expandPath + `exec touch -- "$p"`
+	removeScript   = expandPath + `exec rm -rf -- "$p"`
+	linkScript     = expandPath + `exec ln -sfn -- "$1" "$p"`
+	// takes the ownership, mode and -R to recurse, where a dash indicates that the attribute is left as is
+	fileAttributesScript = expandPath + `r=""; [ "$3" = "-R" ] && r="-R"; ` +
+		`if [ "$1" != "-" ]; then chown -h $r -- "$1" "$p" || exit 1; fi; ` +
+		`if [ "$2" != "-" ]; then chmod $r -- "$2" "$p" || exit 1; fi; exit 0`
+	// appends stdin to the file, creating it and its directory as private to the ownership given
+	authorizedKeysScript = expandPath + `d="${p%/*}"; mkdir -p "$d" && chmod 700 "$d" && chown "$1" "$d" && ` +
+		`cat >> "$p" && chmod 600 "$p" && exec chown "$1" "$p"`
+	// extracts the archive named by $2 (stdin if a dash) of format $1 into the directory, stripping $3 leading components
+	unarchiveScript = expandPath + `mkdir -p "$p" || exit 1; s=""; [ "$3" = 0 ] || s="--strip-components=$3"; ` +
+		`case "$1" in zip) exec unzip -o -q "$2" -d "$p";; tar.gz) z="-z";; *) z="";; esac; exec tar -xo $z -f "$2" $s -C "$p"`
+	// writes a tar archive of the path to stdout, or of its contents if it ends in a slash
+	archiveScript = expandPath + `[ -e "$p" ] || exit 100; case "$p" in */) cd "$p" && exec tar -cf - .;; esac; ` +
+		`cd "$(dirname "$p")" && exec tar -cf - "$(basename "$p")"`
+	// downloads the url $1 with curl or wget alongside the file, moving it into place only if its $2 (sha256 or sha512)
+	// sum is $3
+	downloadScript = expandPath + `t="$p.download"; if command -v curl >/dev/null 2>&1; then curl -fsSL -o "$t" "$1"; ` +
+		`else wget -q -O "$t" "$1"; fi || { rm -f "$t"; exit 1; }; s=$("${2}sum" < "$t" | cut -d " " -f 1); ` +
+		`if [ "$s" != "$3" ]; then rm -f "$t"; echo "checksum mismatch, expected $3 but downloaded $s" >&2; exit 1; fi; ` +
+		`exec mv -f "$t" "$p"`
+	// writes stdin alongside the file (or the target of a link to it), with the mode and ownership of the file when it
+	// exists, then moves it into place so that the file is never seen partially written
+	replaceFileScript = expandPath + `[ -L "$p" ] && p=$(readlink -f -- "$p"); t="$p.crucible-tmp"; ` +
+		`if [ -e "$p" ]; then cp -p -- "$p" "$t" || exit 1; fi; cat > "$t" || { rm -f -- "$t"; exit 1; }; exec mv -f -- "$t" "$p"`
+	// reads lines of paths to archive from stdin, writing the archive to stdout
+	fetchArchiveScript = expandPath + `cd "$p" || exit 1; exec tar -cf - -T -`
+)
+
+// readRemoteFile reads the contents of a remote file, indicating whether or not the file exists
+func (ei *ExecutionInstance) readRemoteFile(ctx context.Context, action *Action, execClient cmdsession.ExecutionClient, path string) ([]byte, bool, error) {
+	cmd, err := ei.privileged(action, []string{ei.config.Executor.ShellBinary, "-c", readFileScript, path})
+	if err != nil {
+		return nil, false, err
+	}
+
+	result, err := ei.executeRemoteCommand(ctx, execClient, nil, cmd)
+	if err != nil {
+		return nil, false, err
+	}
+
+	switch result.exitCode {
+	case 0:
+		return result.stdout, true, nil
+	case missingFileExitCode:
+		return nil, false, nil
+	default:
+		return nil, false, fmt.Errorf("unable to read remote file %s: %w", path, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+}
+
+// remoteExists indicates whether anything exists at the remote path
+func (ei *ExecutionInstance) remoteExists(ctx context.Context, action *Action, execClient cmdsession.ExecutionClient, path string) (bool, error) {
+	cmd, err := ei.privileged(action, []string{ei.config.Executor.ShellBinary, "-c", existsScript, path})
+	if err != nil {
+		return false, err
+	}
+
+	result, err := ei.executeRemoteCommand(ctx, execClient, nil, cmd)
+	if err != nil {
+		return false, err
+	}
+
+	return result.exitCode == 0, nil
+}
+
+// runRemoteScript runs one of the remote scripts against the path, with the privileges of the action and on the host
+// the action targets
+func (ei *ExecutionInstance) runRemoteScript(ctx context.Context, action *Action, script string, path string, stdin io.Reader, args ...string) (*actionResult, error) {
+	cmd, err := ei.privileged(action, append([]string{ei.config.Executor.ShellBinary, "-c", script, path}, args...))
+	if err != nil {
+		return nil, err
+	}
+
+	return ei.executeRemoteCommand(ctx, ei.clientFor(action), stdin, cmd)
+}
+
+// writeRemoteFile writes the content to a remote file, replacing anything which was there before
+func (ei *ExecutionInstance) writeRemoteFile(ctx context.Context, action *Action, execClient cmdsession.ExecutionClient, path string, content []byte) (*actionResult, error) {
+	cmd, err := ei.privileged(action, []string{ei.config.Executor.ShellBinary, "-c", writeFileScript, path})
+	if err != nil {
+		return nil, err
+	}
+
+	return ei.executeRemoteCommand(ctx, execClient, bytes.NewReader(content), cmd)
+}
@@ -2,12 +2,19 @@ package sequence
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"math/rand/v2"
 	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"text/template"
@@ -18,7 +25,6 @@ import (
 	"github.com/frozengoats/crucible/internal/functions"
 	"github.com/frozengoats/crucible/internal/log"
 	"github.com/frozengoats/crucible/internal/render"
-	"github.com/frozengoats/crucible/internal/ssh"
 	"github.com/frozengoats/crucible/internal/utils"
 	"github.com/frozengoats/eval"
 	"github.com/frozengoats/kvstore"
@@ -37,25 +43,305 @@ type ActionContext struct {
 	Error       string
 }
 
+// PlannedAction describes the work an action would have performed, had the sequence not been run in check mode
+type PlannedAction struct {
+	Description string   `json:"description"`
+	Type        string   `json:"type"`
+	Local       bool     `json:"local,omitempty"`
+	Command     []string `json:"command,omitempty"`
+	Src         string   `json:"src,omitempty"`
+	Dest        string   `json:"dest,omitempty"`
+	Content     string   `json:"content,omitempty"`
+	Diff        string   `json:"diff,omitempty"`
+	Files       []string `json:"files,omitempty"`
+	Deleted     []string `json:"deleted,omitempty"`
+	Changes     []string `json:"changes,omitempty"`
+}
+
+// ActionStats tallies the outcome of the actions executed against a host
+type ActionStats struct {
+	Ok      int `json:"ok"`
+	Changed int `json:"changed"`
+	Skipped int `json:"skipped"`
+	Failed  int `json:"failed"`
+	Rescued int `json:"rescued"`
+}
+
+// actionResult holds the outcome of a single action execution
+type actionResult struct {
+	stdout   []byte
+	stderr   []byte
+	exitCode int
+	changed  bool
+}
+
 type SeqPos struct {
 	Name     string
 	Context  *kvstore.Store
 	Sequence *Sequence
 	Position int
+
+	notified map[string]bool // names of the sequence handlers which have been notified
+	handling bool            // true once the sequence actions have completed and notified handlers are being run
+	handlers []*Action       // notified handlers, in the order in which they are run
+
+	block   *Action // the block action being executed at this stack position, if any
+	phase   string  // the section of the block currently being executed
+	failure error   // error raised within the block, which is raised again once the always section completes
+}
+
+const (
+	phaseBlock  string = "block"
+	phaseRescue string = "rescue"
+	phaseAlways string = "always"
+)
+
+// actions returns the list of actions currently being stepped through for this stack position
+func (sp *SeqPos) actions() []*Action {
+	if sp.handling {
+		return sp.handlers
+	}
+
+	if sp.block != nil {
+		switch sp.phase {
+		case phaseRescue:
+			return sp.block.Rescue
+		case phaseAlways:
+			return sp.block.Always
+		default:
+			return sp.block.Block
+		}
+	}
+
+	return sp.Sequence.Sequence
+}
+
+// remainingSteps counts the execution steps which are yet to be reached in the current list of actions, including
+// handlers which have been notified but not yet queued
+func (sp *SeqPos) remainingSteps() int {
+	steps := 0
+	actions := sp.actions()
+	for i := sp.Position + 1; i < len(actions); i++ {
+		steps += actions[i].countExecutionSteps()
+	}
+
+	if sp.block == nil && !sp.handling {
+		steps += len(sp.notified)
+	}
+
+	return steps
 }
 
 type Sync struct {
-	Src           string `yaml:"src"`           // local resource(s) to sync to remote
-	Dest          string `yaml:"dest"`          // remote location to sync to
-	PreserveOwner bool   `yaml:"preserveOwner"` // preserve ownership
-	PreservePerms bool   `yaml:"preservePerms"` // preserve file permissions
-	PreserveGroup bool   `yaml:"preserveGroup"` // preserve group
+	Src           string   `yaml:"src"`           // local resource(s) to sync to remote
+	Dest          string   `yaml:"dest"`          // remote location to sync to
+	PreserveOwner bool     `yaml:"preserveOwner"` // preserve ownership
+	PreservePerms bool     `yaml:"preservePerms"` // preserve file permissions
+	PreserveGroup bool     `yaml:"preserveGroup"` // preserve group
+	Exclude       []string `yaml:"exclude"`       // glob patterns of paths which are neither transferred nor deleted
+	Delete        bool     `yaml:"delete"`        // delete remote paths which do not exist locally, mirroring the src directory
+}
+
+type Fetch struct {
+	Src  string `yaml:"src"`  // remote file or directory to fetch
+	Dest string `yaml:"dest"` // local location to fetch to
+}
+
+// Mode is an octal file mode, which keeps its written form whether or not it is quoted (yaml would otherwise read an
+// unquoted mode with a leading zero as an octal integer, leaving it in decimal form)
+type Mode string
+
+func (m *Mode) UnmarshalYAML(b []byte) error {
+	raw := strings.TrimSpace(string(b))
+	if strings.HasPrefix(raw, "\"") || strings.HasPrefix(raw, "'") {
+		var s string
+		err := yaml.Unmarshal(b, &s)
+		if err != nil {
+			return err
+		}
+		raw = s
+	}
+
+	*m = Mode(raw)
+	return nil
+}
+
+// parse produces the permission bits of the mode, indicating whether or not a mode was set
+func (m Mode) parse() (uint32, bool, error) {
+	if m == "" {
+		return 0, false, nil
+	}
+
+	bits, err := strconv.ParseUint(strings.TrimPrefix(string(m), "0o"), 8, 32)
+	if err != nil || bits > 0o7777 {
+		return 0, false, fmt.Errorf("mode %s is not a valid octal mode", m)
+	}
+
+	return uint32(bits), true, nil
+}
+
+type File struct {
+	Path    string `yaml:"path"`    // remote path to manage
+	State   string `yaml:"state"`   // file (default), directory, link, touch or absent
+	Mode    Mode   `yaml:"mode"`    // octal permissions, e.g. "0755"
+	Owner   string `yaml:"owner"`   // owning user name or uid
+	Group   string `yaml:"group"`   // owning group name or gid
+	Src     string `yaml:"src"`     // target of the link, when the state is link
+	Recurse bool   `yaml:"recurse"` // apply mode, owner and group to everything within a directory
+}
+
+type Copy struct {
+	Src     string  `yaml:"src"`     // local file to copy verbatim, relative to the recipe
+	Content *string `yaml:"content"` // content to write, can be templated and can be empty
+	Dest    string  `yaml:"dest"`    // remote file to write to
+	Mode    Mode    `yaml:"mode"`    // octal permissions, e.g. "0644"
+	Owner   string  `yaml:"owner"`   // owning user name or uid
+	Group   string  `yaml:"group"`   // owning group name or gid
+}
+
+type Package struct {
+	Name        string   `yaml:"name"`        // name of a package, can be templated
+	Names       []string `yaml:"names"`       // names of several packages, can be templated
+	State       string   `yaml:"state"`       // present (default), absent or latest
+	Version     string   `yaml:"version"`     // version to install, only valid with a single package
+	UpdateCache bool     `yaml:"updateCache"` // update the package index before anything else
+}
+
+type Service struct {
+	Name    string `yaml:"name"`    // name of the service, can be templated
+	State   string `yaml:"state"`   // started, stopped, restarted or reloaded
+	Enabled *bool  `yaml:"enabled"` // whether the service starts at boot, left as it is when unspecified
+}
+
+type User struct {
+	Name           string   `yaml:"name"`           // name of the account, can be templated
+	State          string   `yaml:"state"`          // present (default) or absent
+	Uid            *int     `yaml:"uid"`            // user id
+	Group          string   `yaml:"group"`          // primary group name or gid
+	Groups         []string `yaml:"groups"`         // supplementary group names or gids the user is added to, can be templated
+	Shell          string   `yaml:"shell"`          // login shell
+	Home           string   `yaml:"home"`           // home directory, created along with the account
+	System         bool     `yaml:"system"`         // create a system account, without a home directory unless one is given
+	AuthorizedKeys []string `yaml:"authorizedKeys"` // public keys added to ~/.ssh/authorized_keys, can be templated
+}
+
+type Group struct {
+	Name   string `yaml:"name"`   // name of the group, can be templated
+	State  string `yaml:"state"`  // present (default) or absent
+	Gid    *int   `yaml:"gid"`    // group id
+	System bool   `yaml:"system"` // create a system group
+}
+
+type Download struct {
+	Url      string `yaml:"url"`      // url to download, can be templated
+	Dest     string `yaml:"dest"`     // remote file to write to, or directory to write into when ending in a slash
+	Checksum string `yaml:"checksum"` // expected sum of the content as sha256:<hex> or sha512:<hex>, can be templated
+	Remote   bool   `yaml:"remote"`   // download on the remote host with curl or wget rather than pushing it from here
+	Mode     Mode   `yaml:"mode"`     // octal permissions, e.g. "0755"
+	Owner    string `yaml:"owner"`    // owning user name or uid
+	Group    string `yaml:"group"`    // owning group name or gid
+}
+
+type Assertion struct {
+	Eval    string `yaml:"eval"`    // expression which must evaluate to true
+	Message string `yaml:"message"` // message reported should the expression not evaluate to true, can be templated
+}
+
+type Debug struct {
+	Eval    string `yaml:"eval"`    // expression whose result is reported
+	Message string `yaml:"message"` // message to report, can be templated
+}
+
+// DebugMessage is a message reported by a debug action
+type DebugMessage struct {
+	Description string `json:"description"`
+	Message     string `json:"message"`
+}
+
+type Unarchive struct {
+	Src             string `yaml:"src"`             // local archive, relative to the recipe, or remote archive with remoteSrc
+	RemoteSrc       bool   `yaml:"remoteSrc"`       // the src is already on the remote host
+	Dest            string `yaml:"dest"`            // remote directory to extract into, created if it does not exist
+	Creates         string `yaml:"creates"`         // remote path which exists once the archive has been extracted
+	Format          string `yaml:"format"`          // tar, tar.gz or zip, determined from the src extension by default
+	StripComponents int    `yaml:"stripComponents"` // leading path components removed from the extracted paths
+}
+
+type Archive struct {
+	Src    string `yaml:"src"`    // remote file or directory to archive, only its contents if ending in a slash
+	Dest   string `yaml:"dest"`   // local archive to write, relative to the recipe
+	Format string `yaml:"format"` // tar, tar.gz or zip, determined from the dest extension by default
+}
+
+type LineInFile struct {
+	Path         string `yaml:"path"`         // remote file to edit
+	Line         string `yaml:"line"`         // line which should be present, can be templated
+	Regex        string `yaml:"regex"`        // regular expression of the line to replace, or of the lines to remove when absent
+	State        string `yaml:"state"`        // present (default) or absent
+	InsertAfter  string `yaml:"insertAfter"`  // regular expression of the line after which a new line is inserted, defaults to the end of the file
+	InsertBefore string `yaml:"insertBefore"` // regular expression of the line before which a new line is inserted
+	Create       bool   `yaml:"create"`       // create the file if it does not exist
+	Backup       bool   `yaml:"backup"`       // keep a timestamped copy of the file before changing it
+}
+
+type BlockInFile struct {
+	Path         string `yaml:"path"`         // remote file to edit
+	Block        string `yaml:"block"`        // content of the block, can be templated
+	Marker       string `yaml:"marker"`       // marker line surrounding the block, where {mark} is replaced by BEGIN and END
+	State        string `yaml:"state"`        // present (default) or absent
+	InsertAfter  string `yaml:"insertAfter"`  // regular expression of the line after which a new block is inserted, defaults to the end of the file
+	InsertBefore string `yaml:"insertBefore"` // regular expression of the line before which a new block is inserted
+	Create       bool   `yaml:"create"`       // create the file if it does not exist
+	Backup       bool   `yaml:"backup"`       // keep a timestamped copy of the file before changing it
+}
+
+type WaitFor struct {
+	Port     int     `yaml:"port"`     // tcp port to wait upon
+	Host     string  `yaml:"host"`     // host of the port, as seen from the host being waited upon, defaults to localhost
+	Path     string  `yaml:"path"`     // file or directory to wait upon
+	Regex    string  `yaml:"regex"`    // regular expression which must match the contents of the file at path
+	Url      string  `yaml:"url"`      // http(s) url to wait upon
+	Status   int     `yaml:"status"`   // http status the url must return, defaults to 200
+	Insecure bool    `yaml:"insecure"` // skip verification of the certificate of an https url
+	State    string  `yaml:"state"`    // present (default) to wait for the port to be open or file/regex to exist, or absent for the opposite
+	Timeout  float64 `yaml:"timeout"`  // seconds to wait before failing, defaults to 300
+	Interval float64 `yaml:"interval"` // seconds between checks, defaults to 1
 }
 
 type Until struct {
 	PauseInterval float64 `yaml:"pauseInterval"` // interval in seconds to pause between next action execution if until condition is not met
 	MaxAttempts   int     `yaml:"maxAttempts"`   // max attempts to execute the action if the condition is not met
 	Condition     string  `yaml:"condition"`     // condition which must evaluate to true in order to stop execution
+	Backoff       float64 `yaml:"backoff"`       // multiplier applied to the pause interval after every unsuccessful attempt
+	MaxInterval   float64 `yaml:"maxInterval"`   // upper limit in seconds of the pause interval once backoff is applied
+	Jitter        float64 `yaml:"jitter"`        // fraction of the pause interval (0-1) randomly added or removed from each pause
+	Timeout       float64 `yaml:"timeout"`       // total number of seconds to keep attempting the action for, including pauses
+}
+
+// interval produces the pause which follows the given (1 based) unsuccessful attempt
+func (u *Until) interval(attempt int) time.Duration {
+	interval := u.PauseInterval
+	if u.Backoff > 0 {
+		interval *= math.Pow(u.Backoff, float64(attempt-1))
+	}
+	if u.MaxInterval > 0 && interval > u.MaxInterval {
+		interval = u.MaxInterval
+	}
+	if u.Jitter > 0 {
+		interval += interval * u.Jitter * (2*rand.Float64() - 1)
+	}
+
+	return seconds(interval)
+}
+
+// exhausted indicates whether no further attempts may be made after the given number of unsuccessful attempts.
+// without a maxAttempts, attempts are bounded only by the timeout.
+func (u *Until) exhausted(attempts int) bool {
+	if u.MaxAttempts <= 0 && u.Timeout > 0 {
+		return false
+	}
+
+	return attempts >= u.MaxAttempts
 }
 
 type Template struct {
@@ -75,30 +361,142 @@ type Pause struct {
 }
 
 type Action struct {
-	Name           string    `yaml:"name"`           // the name of the action, referrable from other actions (unnamed actions will not capture or retain data)
-	Description    string    `yaml:"description"`    // action description
-	Iterate        string    `yaml:"iterate"`        // if an iterable is provided, it will be iterated and the child action will be called for each element
-	Import         *Import   `yaml:"import"`         // if specified, a sequence is imported from a location relative to the top level config.yaml
-	When           string    `yaml:"when"`           // conditional expression which must evaluate to true, in order for the action or loop to be executed
-	FailWhen       string    `yaml:"failWhen"`       // conditional expression which when evaluating to true indicates a failure (failures are otherwise implicit to command execution return codes)
-	IgnoreExitCode bool      `yaml:"ignoreExitCode"` // ignores the exit code of an execution, so that it does not cause the sequence to terminate
-	PostProcess    string    `yaml:"postProcess"`    // evaluable expression which has access to the context (including local), and executes only when the exit code is 0, result is stored .postProcess
-	Until          *Until    `yaml:"until"`          // execute action until the condition evaluates to true
-	Action         *Action   `yaml:"action"`         // action to be executed if an iterable is present as well
-	ParseJson      bool      `yaml:"parseJson"`      // processes the standard output as JSON and makes the data available on the .kv context of the action
-	ParseYaml      bool      `yaml:"parseYaml"`      // processes the standard output as YAML and makes the data available on the .kv context of the action
-	Su             string    `yaml:"su"`             // switch to the following user (can be a name or base 10 string of a numeric id)
-	Sudo           bool      `yaml:"sudo"`           // run the command as root
-	SubSequence    *Sequence `yaml:"subSequence"`    // sub sequence if imported
-	Local          bool      `yaml:"local"`          // when true, action will be executed locally instead of remotely, this is useful for preparing local assets which might need to be present locally but not remotely
-	Pause          *Pause    `yaml:"pause"`          // pause for n seconds before and/or after the action
+	Name           string            `yaml:"name"`           // the name of the action, referrable from other actions (unnamed actions will not capture or retain data)
+	Description    string            `yaml:"description"`    // action description
+	Iterate        string            `yaml:"iterate"`        // if an iterable is provided, it will be iterated and the child action will be called for each element
+	Import         *Import           `yaml:"import"`         // if specified, a sequence is imported from a location relative to the top level config.yaml
+	When           string            `yaml:"when"`           // conditional expression which must evaluate to true, in order for the action or loop to be executed
+	FailWhen       string            `yaml:"failWhen"`       // conditional expression which when evaluating to true indicates a failure (failures are otherwise implicit to command execution return codes)
+	ChangedWhen    string            `yaml:"changedWhen"`    // conditional expression which determines whether the action changed anything, overriding the action's own assessment
+	IgnoreExitCode bool              `yaml:"ignoreExitCode"` // ignores the exit code of an execution, so that it does not cause the sequence to terminate
+	PostProcess    string            `yaml:"postProcess"`    // evaluable expression which has access to the context (including local), and executes only when the exit code is 0, result is stored .postProcess
+	Until          *Until            `yaml:"until"`          // execute action until the condition evaluates to true
+	Notify         []string          `yaml:"notify"`         // names of handlers to run at the end of the sequence, should the action report a change
+	Action         *Action           `yaml:"action"`         // action to be executed if an iterable is present as well
+	ParseJson      bool              `yaml:"parseJson"`      // processes the standard output as JSON and makes the data available on the .kv context of the action
+	ParseYaml      bool              `yaml:"parseYaml"`      // processes the standard output as YAML and makes the data available on the .kv context of the action
+	Su             string            `yaml:"su"`             // switch to the following user (can be a name or base 10 string of a numeric id)
+	Sudo           bool              `yaml:"sudo"`           // run the command as root
+	SubSequence    *Sequence         `yaml:"subSequence"`    // sub sequence if imported
+	Local          bool              `yaml:"local"`          // when true, action will be executed locally instead of remotely, this is useful for preparing local assets which might need to be present locally but not remotely
+	Pause          *Pause            `yaml:"pause"`          // pause for n seconds before and/or after the action
+	Timeout        float64           `yaml:"timeout"`        // maximum number of seconds the action may run for before it is terminated and fails
+	Stream         bool              `yaml:"stream"`         // log command output as it arrives, rather than only capturing it
+	Env            map[string]string `yaml:"env"`            // environment variables to set for shell/exec commands, values can be templated
+	Chdir          string            `yaml:"chdir"`          // directory in which to run shell/exec commands, can be templated
+	Block          []*Action         `yaml:"block"`          // list of actions to execute as a group, allowing failures to be handled by rescue and always
+	Rescue         []*Action         `yaml:"rescue"`         // list of actions to execute should any action in the block fail
+	Always         []*Action         `yaml:"always"`         // list of actions to execute once the block (and rescue) completes, regardless of failure
 
 	// these properties are independent action properties, mutually exclusive
-	Stdin    string    `yaml:"stdin"`    // only valid with exec/shell
-	Exec     []string  `yaml:"exec"`     // execute a command
-	Shell    string    `yaml:"shell"`    // execute a command using sh
-	Sync     *Sync     `yaml:"sync"`     // sync files from local to remote
-	Template *Template `yaml:"template"` // render a template
+	Stdin       string         `yaml:"stdin"`       // only valid with exec/shell
+	Exec        []string       `yaml:"exec"`        // execute a command
+	Shell       string         `yaml:"shell"`       // execute a command using sh
+	Sync        *Sync          `yaml:"sync"`        // sync files from local to remote
+	Template    *Template      `yaml:"template"`    // render a template
+	Fetch       *Fetch         `yaml:"fetch"`       // fetch files from remote to local
+	WaitFor     *WaitFor       `yaml:"waitFor"`     // wait for a port, file or url to become ready
+	File        *File          `yaml:"file"`        // manage a remote file, directory or link and its attributes
+	LineInFile  *LineInFile    `yaml:"lineInFile"`  // ensure a line is present in or absent from a remote file
+	BlockInFile *BlockInFile   `yaml:"blockInFile"` // ensure a marked block is present in or absent from a remote file
+	Copy        *Copy          `yaml:"copy"`        // copy a local file or inline content to a remote file
+	Package     *Package       `yaml:"package"`     // install, upgrade or remove packages using the package manager of the host
+	Service     *Service       `yaml:"service"`     // start, stop, restart or reload a service, and enable or disable it
+	User        *User          `yaml:"user"`        // create, modify or remove a user account
+	Group       *Group         `yaml:"group"`       // create, modify or remove a group
+	Unarchive   *Unarchive     `yaml:"unarchive"`   // extract a local or remote archive on the remote host
+	Archive     *Archive       `yaml:"archive"`     // archive a remote file or directory to the local system
+	Download    *Download      `yaml:"download"`    // download a url to a remote file, verifying its checksum
+	Assert      []*Assertion   `yaml:"assert"`      // fail unless every expression evaluates to true, without executing anything
+	Debug       *Debug         `yaml:"debug"`       // report an evaluated expression or message, without executing anything
+	Set         map[string]any `yaml:"set"`         // store values, which can be templated, on the context without executing anything
+	Persist     bool           `yaml:"persist"`     // also store the values of set in the persistent facts of the host
+}
+
+// executesOnHost indicates whether the action performs work against the host, which check mode reports rather than
+// performs.  assert, debug and set actions only evaluate expressions, so they are performed as usual in check mode.
+func (a *Action) executesOnHost() bool {
+	switch a.Type() {
+	case "", "assert", "debug", "set":
+		return false
+	default:
+		return true
+	}
+}
+
+// types returns every kind of work declared by the action, of which a valid action declares at most one
+func (a *Action) types() []string {
+	var types []string
+	if a.Shell != "" {
+		types = append(types, "shell")
+	}
+	if len(a.Exec) > 0 {
+		types = append(types, "exec")
+	}
+	if a.Sync != nil {
+		types = append(types, "sync")
+	}
+	if a.Template != nil {
+		types = append(types, "template")
+	}
+	if a.Fetch != nil {
+		types = append(types, "fetch")
+	}
+	if a.WaitFor != nil {
+		types = append(types, "waitFor")
+	}
+	if a.File != nil {
+		types = append(types, "file")
+	}
+	if a.LineInFile != nil {
+		types = append(types, "lineInFile")
+	}
+	if a.BlockInFile != nil {
+		types = append(types, "blockInFile")
+	}
+	if a.Copy != nil {
+		types = append(types, "copy")
+	}
+	if a.Package != nil {
+		types = append(types, "package")
+	}
+	if a.Service != nil {
+		types = append(types, "service")
+	}
+	if a.User != nil {
+		types = append(types, "user")
+	}
+	if a.Group != nil {
+		types = append(types, "group")
+	}
+	if a.Unarchive != nil {
+		types = append(types, "unarchive")
+	}
+	if a.Archive != nil {
+		types = append(types, "archive")
+	}
+	if a.Download != nil {
+		types = append(types, "download")
+	}
+	if len(a.Assert) > 0 {
+		types = append(types, "assert")
+	}
+	if a.Debug != nil {
+		types = append(types, "debug")
+	}
+	if len(a.Set) > 0 {
+		types = append(types, "set")
+	}
+	return types
+}
+
+// Type returns the kind of work performed by the action, or an empty string if the action performs none
+func (a *Action) Type() string {
+	types := a.types()
+	if len(types) == 0 {
+		return ""
+	}
+	return types[0]
 }
 
 func (a *Action) Lint(recipePath string) (bool, error) {
@@ -122,6 +520,17 @@ func (a *Action) Lint(recipePath string) (bool, error) {
 		}
 	}
 
+	for _, nested := range a.nestedActions() {
+		ok, err := nested.Lint(recipePath)
+		if err != nil {
+			return false, err
+		}
+
+		if !ok {
+			lintOk = false
+		}
+	}
+
 	return lintOk, nil
 }
 
@@ -132,16 +541,203 @@ func (a *Action) Validate() error {
 		}
 	}
 
+	if types := a.types(); len(types) > 1 {
+		return fmt.Errorf("action \"%s\" declares more than one of %s, only one can be performed", a.Description, strings.Join(types, ", "))
+	}
+
+	if a.Block == nil {
+		if a.Rescue != nil || a.Always != nil {
+			return fmt.Errorf("action \"%s\" declares rescue or always without a block", a.Description)
+		}
+	} else {
+		if a.Type() != "" || a.Import != nil || a.Iterate != "" {
+			return fmt.Errorf("block action \"%s\" cannot also iterate, import or perform any other action", a.Description)
+		}
+	}
+
+	for k := range a.Env {
+		if !nameValidator.MatchString(k) {
+			return fmt.Errorf("action \"%s\" has an invalid environment variable name \"%s\"", a.Description, k)
+		}
+	}
+
+	if a.Until != nil {
+		if a.Until.PauseInterval < 0 || a.Until.MaxInterval < 0 || a.Until.Timeout < 0 {
+			return fmt.Errorf("action \"%s\" has a negative until interval or timeout", a.Description)
+		}
+		if a.Until.Backoff != 0 && a.Until.Backoff < 1 {
+			return fmt.Errorf("action \"%s\" has an until backoff less than 1", a.Description)
+		}
+		if a.Until.Jitter < 0 || a.Until.Jitter > 1 {
+			return fmt.Errorf("action \"%s\" has an until jitter outside of 0-1", a.Description)
+		}
+	}
+
+	if a.Sync != nil {
+		for _, pattern := range a.Sync.Exclude {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("sync action \"%s\" has an invalid exclude pattern \"%s\"", a.Description, pattern)
+			}
+		}
+	}
+
+	if a.WaitFor != nil {
+		if err := a.WaitFor.validate(); err != nil {
+			return fmt.Errorf("waitFor action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.File != nil {
+		if err := a.File.validate(); err != nil {
+			return fmt.Errorf("file action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.LineInFile != nil {
+		if err := a.LineInFile.validate(); err != nil {
+			return fmt.Errorf("lineInFile action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.BlockInFile != nil {
+		if err := a.BlockInFile.validate(); err != nil {
+			return fmt.Errorf("blockInFile action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.Copy != nil {
+		if err := a.Copy.validate(); err != nil {
+			return fmt.Errorf("copy action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.Package != nil {
+		if err := a.Package.validate(); err != nil {
+			return fmt.Errorf("package action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.Service != nil {
+		if err := a.Service.validate(); err != nil {
+			return fmt.Errorf("service action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.User != nil {
+		if err := a.User.validate(); err != nil {
+			return fmt.Errorf("user action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.Group != nil {
+		if err := a.Group.validate(); err != nil {
+			return fmt.Errorf("group action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.Unarchive != nil {
+		if err := a.Unarchive.validate(); err != nil {
+			return fmt.Errorf("unarchive action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.Archive != nil {
+		if err := a.Archive.validate(); err != nil {
+			return fmt.Errorf("archive action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	if a.Download != nil {
+		if err := a.Download.validate(); err != nil {
+			return fmt.Errorf("download action \"%s\" is invalid: %w", a.Description, err)
+		}
+	}
+
+	for i, assertion := range a.Assert {
+		if assertion.Eval == "" {
+			return fmt.Errorf("assert action \"%s\" is invalid: assertion %d has no eval expression", a.Description, i)
+		}
+	}
+
+	if a.Debug != nil {
+		if (a.Debug.Eval == "") == (a.Debug.Message == "") {
+			return fmt.Errorf("debug action \"%s\" is invalid: exactly one of eval or message must be specified", a.Description)
+		}
+	}
+
+	for k := range a.Set {
+		if !nameValidator.MatchString(k) {
+			return fmt.Errorf("set action \"%s\" has an invalid key \"%s\"", a.Description, k)
+		}
+		if k == ImmediateKey || slices.Contains(reservedImmediateKeys, k) {
+			return fmt.Errorf("set action \"%s\" cannot set \"%s\", which is reserved by the immediate context", a.Description, k)
+		}
+	}
+	if a.Persist && len(a.Set) == 0 {
+		return fmt.Errorf("action \"%s\" can only persist the values of set", a.Description)
+	}
+
+	for _, nested := range a.nestedActions() {
+		err := nested.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
+// nestedActions returns all actions contained within the block, rescue and always sections of the action
+func (a *Action) nestedActions() []*Action {
+	var nested []*Action
+	nested = append(nested, a.Block...)
+	nested = append(nested, a.Rescue...)
+	nested = append(nested, a.Always...)
+	return nested
+}
+
+// countExecutionSteps counts the execution steps the action will take, not including any rescue actions, since
+// these only run on failure
+func (a *Action) countExecutionSteps() int {
+	if a.SubSequence != nil {
+		return a.SubSequence.CountExecutionSteps()
+	}
+
+	if a.Block != nil {
+		return countExecutionSteps(a.Block) + countExecutionSteps(a.Always)
+	}
+
+	return 1
+}
+
+func countExecutionSteps(actions []*Action) int {
+	steps := 0
+	for _, a := range actions {
+		steps += a.countExecutionSteps()
+	}
+
+	return steps
+}
+
 type Sequence struct {
 	Name        string    `yaml:"name"`
 	Description string    `yaml:"description"`
 	Sequence    []*Action `yaml:"sequence"`
+	Handlers    []*Action `yaml:"handlers,omitempty"` // named actions which run once at the end of the sequence, only when notified
 	filename    string
 }
 
+// handler returns the handler with the given name, or nil if the sequence has no such handler
+func (s *Sequence) handler(name string) *Action {
+	for _, h := range s.Handlers {
+		if h.Name == name {
+			return h
+		}
+	}
+
+	return nil
+}
+
 func (s *Sequence) Lint(recipePath string) (bool, error) {
 	lintOk := true
 
@@ -162,6 +758,16 @@ func (s *Sequence) Lint(recipePath string) (bool, error) {
 		}
 	}
 
+	for _, handler := range s.Handlers {
+		ok, err := handler.Lint(recipePath)
+		if err != nil {
+			return false, err
+		}
+		if !ok {
+			lintOk = false
+		}
+	}
+
 	return lintOk, nil
 }
 
@@ -179,20 +785,31 @@ func (s *Sequence) Validate() error {
 		}
 	}
 
-	return nil
-}
+	handlerNames := map[string]struct{}{}
+	for _, h := range s.Handlers {
+		if h.Name == "" {
+			return fmt.Errorf("handler \"%s\" must have a name by which it can be notified", h.Description)
+		}
+		if _, ok := handlerNames[h.Name]; ok {
+			return fmt.Errorf("handler name \"%s\" is used more than once", h.Name)
+		}
+		handlerNames[h.Name] = struct{}{}
 
-func (s *Sequence) CountExecutionSteps() int {
-	steps := 0
-	for _, seq := range s.Sequence {
-		if seq.SubSequence != nil {
-			steps += seq.SubSequence.CountExecutionSteps()
-		} else {
-			steps++
+		if h.Import != nil {
+			return fmt.Errorf("handler \"%s\" cannot import a sequence", h.Name)
+		}
+
+		err := h.Validate()
+		if err != nil {
+			return err
 		}
 	}
 
-	return steps
+	return validateSetKeys(append(append([]*Action{}, s.Sequence...), s.Handlers...))
+}
+
+func (s *Sequence) CountExecutionSteps() int {
+	return countExecutionSteps(s.Sequence)
 }
 
 func LoadSequence(cwdPath string, filename string) (*Sequence, error) {
@@ -213,28 +830,42 @@ func LoadSequence(cwdPath string, filename string) (*Sequence, error) {
 		return nil, err
 	}
 
-	// iterate the actions in the sequence
-	for _, a := range s.Sequence {
+	err = resolveImports(cwdPath, s.Sequence)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, err
+}
+
+// resolveImports loads the sub sequences of all importing actions, including those nested within blocks
+func resolveImports(cwdPath string, actions []*Action) error {
+	for _, a := range actions {
 		if a.Import != nil {
 			importPath, err := filepath.Abs(filepath.Join(cwdPath, a.Import.Path))
 			if err != nil {
-				return nil, fmt.Errorf("unable to resolve import path for %s\n%w", a.Import, err)
+				return fmt.Errorf("unable to resolve import path for %s\n%w", a.Import, err)
 			}
 
 			a.SubSequence, err = LoadSequence(cwdPath, importPath)
 			if err != nil {
-				return nil, fmt.Errorf("unable to load sub sequence at %s\n%w", importPath, err)
+				return fmt.Errorf("unable to load sub sequence at %s\n%w", importPath, err)
 			}
 			a.SubSequence.filename = importPath
 			if err := a.SubSequence.Validate(); err != nil {
-				return nil, err
+				return err
 			}
 
 			a.SubSequence.Name = a.Name
 		}
+
+		err := resolveImports(cwdPath, a.nestedActions())
+		if err != nil {
+			return err
+		}
 	}
 
-	return s, err
+	return nil
 }
 
 type ExecutionInstance struct {
@@ -248,8 +879,12 @@ type ExecutionInstance struct {
 	executionStack       []SeqPos
 	currentExecutionStep int
 	ImmediateContexts    []*ActionContext
-	ExecContext          *kvstore.Store // context accumulated through execution ()
-	HostContext          *kvstore.Store // per host config context
+	Plan                 []*PlannedAction // actions which would have been performed, populated only in check mode
+	Messages             []*DebugMessage  // messages reported by debug actions
+	Stats                ActionStats      // outcome tallies of all actions executed
+	ExecContext          *kvstore.Store   // context accumulated through execution ()
+	HostContext          *kvstore.Store   // per host config context
+	facts                *kvstore.Store   // per host facts persisted between runs, loaded when first used
 	lock                 sync.Mutex
 
 	err error
@@ -346,8 +981,37 @@ func (ei *ExecutionInstance) Next() (*Action, error) {
 		if !started {
 			stackItem.Position++
 		}
+		started = false
+
+		if stackItem.Position >= len(stackItem.actions()) {
+			if stackItem.block != nil {
+				if stackItem.phase != phaseAlways && len(stackItem.block.Always) > 0 {
+					stackItem.phase = phaseAlways
+					stackItem.Position = -1
+					continue
+				}
+
+				// blocks share the context of their parent, so there is nothing to collapse onto it
+				failure := stackItem.failure
+				ei.executionStack = ei.executionStack[:stackIndex]
+				if failure != nil && !ei.rescue(failure) {
+					return nil, failure
+				}
+				continue
+			}
+
+			if !stackItem.handling && len(stackItem.notified) > 0 {
+				// run the notified handlers, in the order in which they are declared, before the sequence completes
+				stackItem.handling = true
+				for _, h := range stackItem.Sequence.Handlers {
+					if stackItem.notified[h.Name] {
+						stackItem.handlers = append(stackItem.handlers, h)
+					}
+				}
+				stackItem.Position = -1
+				continue
+			}
 
-		if stackItem.Position >= len(stackItem.Sequence.Sequence) {
 			// pop this item off the stack and move onto the next
 			// when the stack is collapsed, the last context is written to the parent context, under
 			// the key representing the name of the collapsed sequence
@@ -365,10 +1029,10 @@ func (ei *ExecutionInstance) Next() (*Action, error) {
 				ei.executionStack = []SeqPos{}
 			}
 		} else {
-			action := stackItem.Sequence.Sequence[stackItem.Position]
-			if action.SubSequence == nil {
+			action := stackItem.actions()[stackItem.Position]
+			ei.ExecContext = stackItem.Context
+			if action.SubSequence == nil && action.Block == nil {
 				ei.currentExecutionStep++
-				ei.ExecContext = ei.executionStack[len(ei.executionStack)-1].Context
 				return action, nil
 			}
 
@@ -381,11 +1045,25 @@ func (ei *ExecutionInstance) Next() (*Action, error) {
 				return nil, err
 			}
 			if !isWhenSatisfied {
-				ei.currentExecutionStep += action.SubSequence.CountExecutionSteps()
-				context := []any{
+				ei.currentExecutionStep += action.countExecutionSteps()
+				ei.Stats.Skipped++
+				logCtx := []any{
 					"host", ei.hostIdent,
 				}
-				log.Info(context, "skipping due to falsey when clause")
+				log.Info(logCtx, "skipping due to falsey when clause")
+				continue
+			}
+
+			if action.Block != nil {
+				// blocks execute within the context of the sequence containing them
+				log.Info([]any{"host", ei.hostIdent}, "entering block \"%s\"", action.Description)
+				ei.executionStack = append(ei.executionStack, SeqPos{
+					Context:  stackItem.Context,
+					Sequence: stackItem.Sequence,
+					Position: -1,
+					block:    action,
+					phase:    phaseBlock,
+				})
 				continue
 			}
 
@@ -400,22 +1078,123 @@ func (ei *ExecutionInstance) Next() (*Action, error) {
 					evalContext[k] = evalV
 				}
 
-				newContext, err = kvstore.FromMapping(evalContext)
-				if err != nil {
-					return nil, fmt.Errorf("unable to construct sequence context: %w", err)
-				}
-			} else {
-				newContext = kvstore.NewStore()
+				newContext, err = kvstore.FromMapping(evalContext)
+				if err != nil {
+					return nil, fmt.Errorf("unable to construct sequence context: %w", err)
+				}
+			} else {
+				newContext = kvstore.NewStore()
+			}
+
+			ei.executionStack = append(ei.executionStack, SeqPos{
+				Name:     action.Name,
+				Context:  newContext,
+				Sequence: action.SubSequence,
+				Position: -1,
+			})
+		}
+	}
+}
+
+// Rescue hands the failure of an action over to the innermost enclosing block able to handle it, returning false
+// if no such block exists, in which case the failure is terminal
+func (ei *ExecutionInstance) Rescue(err error) bool {
+	ei.lock.Lock()
+	defer ei.lock.Unlock()
+
+	return ei.rescue(err)
+}
+
+func (ei *ExecutionInstance) rescue(err error) bool {
+	for i := len(ei.executionStack) - 1; i >= 0; i-- {
+		stackItem := &ei.executionStack[i]
+		if stackItem.block == nil {
+			continue
+		}
+
+		canRescue := stackItem.phase == phaseBlock && len(stackItem.block.Rescue) > 0
+		canFinalize := stackItem.phase != phaseAlways && len(stackItem.block.Always) > 0
+		if !canRescue && !canFinalize {
+			continue
+		}
+
+		// everything which would have followed the failure within the block is abandoned
+		for j := len(ei.executionStack) - 1; j >= i; j-- {
+			ei.currentExecutionStep += ei.executionStack[j].remainingSteps()
+		}
+		ei.executionStack = ei.executionStack[:i+1]
+		stackItem = &ei.executionStack[i]
+		stackItem.Position = -1
+		ei.ExecContext = stackItem.Context
+
+		logCtx := []any{
+			"host", ei.hostIdent,
+		}
+		if canRescue {
+			log.Info(logCtx, "rescuing block \"%s\"", stackItem.block.Description)
+			stackItem.phase = phaseRescue
+			ei.totalExecutionSteps += countExecutionSteps(stackItem.block.Rescue)
+			ei.Stats.Rescued++
+			setErr := stackItem.Context.Set(map[string]any{"error": err.Error()}, "failure")
+			if setErr != nil {
+				log.Error(logCtx, "unable to record failure on the context: %s", setErr.Error())
+			}
+		} else {
+			log.Info(logCtx, "running always section of block \"%s\" before failing", stackItem.block.Description)
+			stackItem.phase = phaseAlways
+			stackItem.failure = err
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// notify flags the handlers named by the action to be run at the end of the sequence which declares them
+func (ei *ExecutionInstance) notify(action *Action) error {
+	ei.lock.Lock()
+	defer ei.lock.Unlock()
+
+	for _, name := range action.Notify {
+		found := false
+		// handlers are resolved from the innermost sequence outwards, allowing imported sequences to notify their parents
+		for i := len(ei.executionStack) - 1; i >= 0; i-- {
+			stackItem := &ei.executionStack[i]
+			if stackItem.block != nil {
+				// blocks share their sequence with the stack position below, which is where handlers are tracked
+				continue
+			}
+			handler := stackItem.Sequence.handler(name)
+			if handler == nil {
+				continue
+			}
+
+			found = true
+			if stackItem.notified[name] {
+				break
+			}
+			if stackItem.notified == nil {
+				stackItem.notified = map[string]bool{}
+			}
+			stackItem.notified[name] = true
+			// a handler may be a block, taking as many steps as the actions within it
+			ei.totalExecutionSteps += countExecutionSteps([]*Action{handler})
+
+			// handlers notified while handlers are already running are queued up behind them
+			if stackItem.handling {
+				stackItem.handlers = append(stackItem.handlers, handler)
 			}
+			log.Debug([]any{"host", ei.hostIdent}, "notified handler \"%s\"", name)
+			break
+		}
 
-			ei.executionStack = append(ei.executionStack, SeqPos{
-				Name:     action.Name,
-				Context:  newContext,
-				Sequence: action.SubSequence,
-				Position: -1,
-			})
+		if !found {
+			return fmt.Errorf("no handler named \"%s\" exists to be notified", name)
 		}
 	}
+
+	return nil
 }
 
 func (ei *ExecutionInstance) variableLookup(key string) (any, error) {
@@ -426,9 +1205,18 @@ func (ei *ExecutionInstance) variableLookup(key string) (any, error) {
 	} else if strings.HasPrefix(key, ".Context.") {
 		key = strings.TrimPrefix(key, ".Context.")
 		store = ei.ExecContext
+	} else if key == ".HostIdent" {
+		return ei.hostIdent, nil
 	} else if strings.HasPrefix(key, ".Host.") {
 		key = strings.TrimPrefix(key, ".Host.")
 		store = ei.HostContext
+	} else if strings.HasPrefix(key, ".Facts.") {
+		key = strings.TrimPrefix(key, ".Facts.")
+		facts, err := ei.Facts()
+		if err != nil {
+			return nil, err
+		}
+		store = facts
 	} else {
 		// assume immediate context if not prefixed by one of the two known namespace classifiers
 		key = fmt.Sprintf("%s%s", ImmediateKey, key)
@@ -456,83 +1244,181 @@ func (ei *ExecutionInstance) whenSatisfied(action *Action) (bool, error) {
 	return eval.IsTruthy(whenResult), nil
 }
 
-func (ei *ExecutionInstance) Execute(action *Action) error {
-	context := []any{
+// Execute executes the action, tallying its outcome in the execution statistics.  cancelling ctx, or exceeding the
+// action's own timeout, terminates any command running on the host.
+func (ei *ExecutionInstance) Execute(ctx context.Context, action *Action) error {
+	_, err := ei.execute(ctx, action)
+	return err
+}
+
+// withTimeout bounds ctx by the timeout in seconds, if there is one
+func withTimeout(ctx context.Context, timeout float64) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+
+	d := seconds(timeout)
+	return context.WithTimeoutCause(ctx, d, cmdsession.NewTimeoutError(d))
+}
+
+// sleep pauses for the given number of seconds, returning early with an error if ctx is cancelled
+func sleep(ctx context.Context, s float64) error {
+	t := time.NewTimer(seconds(s))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// seconds converts a fractional number of seconds to a duration
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// execute executes the action, returning whether or not it changed anything on the host
+func (ei *ExecutionInstance) execute(ctx context.Context, action *Action) (bool, error) {
+	err := ctx.Err()
+	if err != nil {
+		ei.Stats.Failed++
+		return false, context.Cause(ctx)
+	}
+
+	ctx, cancel := withTimeout(ctx, action.Timeout)
+	defer cancel()
+
+	logCtx := []any{
 		"host", ei.hostIdent,
 	}
-	log.Info(context, "processing action \"%s\"", action.Description)
+	log.Info(logCtx, "processing action \"%s\"", action.Description)
 
 	if action.Pause != nil && action.Pause.Before > 0 {
-		log.Debug(context, "pausing before action execution for %0.2f seconds", action.Pause.Before)
-		time.Sleep(time.Second * time.Duration(action.Pause.Before))
+		log.Debug(logCtx, "pausing before action execution for %0.2f seconds", action.Pause.Before)
+		err = sleep(ctx, action.Pause.Before)
+		if err != nil {
+			ei.Stats.Failed++
+			return false, err
+		}
 	}
 
 	isWhenSatisfied, err := ei.whenSatisfied(action)
 	if err != nil {
-		return err
+		ei.Stats.Failed++
+		return false, err
 	}
 	if !isWhenSatisfied {
-		log.Info(context, "skipping due to falsey when clause")
-		return nil
+		ei.Stats.Skipped++
+		log.Info(logCtx, "skipping due to falsey when clause")
+		return false, nil
 	}
 
 	if action.Iterate != "" {
 		iterableResult, err := eval.Evaluate(action.Iterate, ei.variableLookup, functions.Call)
 		if err != nil {
-			return fmt.Errorf("unable to evaluate interable attribute: %s\n%w", action.Iterate, err)
+			ei.Stats.Failed++
+			return false, fmt.Errorf("unable to evaluate interable attribute: %s\n%w", action.Iterate, err)
 		}
 
 		iterableArray, ok := iterableResult.([]any)
 		if !ok {
-			return fmt.Errorf("iterate attribute does not return an array")
+			ei.Stats.Failed++
+			return false, fmt.Errorf("iterate attribute does not return an array")
 		}
 
+		anyChanged := false
 		for i, item := range iterableArray {
 			err = ei.ExecContext.Set(item, ImmediateKey, "item")
 			if err != nil {
-				return err
+				return false, err
 			}
 			action.Action.Description = fmt.Sprintf("%s (iteration %d of %d)", action.Description, i+1, len(iterableArray))
-			err = ei.Execute(action.Action)
+			changed, err := ei.execute(ctx, action.Action)
 			if err != nil {
-				return err
+				return false, err
+			}
+			anyChanged = anyChanged || changed
+		}
+
+		if anyChanged && len(action.Notify) > 0 {
+			err = ei.notify(action)
+			if err != nil {
+				return false, err
 			}
 		}
 
 		// since iterables call an internal action, once this is done, there's no continuing
-		return nil
+		return anyChanged, nil
+	}
+
+	changed, err := ei.performAction(ctx, action)
+	if err != nil {
+		ei.Stats.Failed++
+		return false, err
+	}
+
+	if changed {
+		ei.Stats.Changed++
+		if len(action.Notify) > 0 {
+			err = ei.notify(action)
+			if err != nil {
+				return false, err
+			}
+		}
+	} else {
+		ei.Stats.Ok++
+	}
+	return changed, nil
+}
+
+// performAction performs a single action, including any retries, result processing and failure conditions
+func (ei *ExecutionInstance) performAction(ctx context.Context, action *Action) (bool, error) {
+	logCtx := []any{
+		"host", ei.hostIdent,
 	}
 
-	// this for loop will break immediately unless an until clause is set
-	var stdout []byte
-	var exitCode int
+	// this for loop will break immediately unless an until clause is set, in which case its timeout bounds every attempt
+	var result *actionResult
+	var err error
 	untilAttempts := 0
+	if action.Until != nil {
+		var cancel func()
+		ctx, cancel = withTimeout(ctx, action.Until.Timeout)
+		defer cancel()
+	}
 	for {
-		stdout, exitCode, err = ei.executeSingleAction(action)
+		result, err = ei.executeSingleAction(ctx, action)
 		if err != nil {
 			ei.ImmediateContexts = append(ei.ImmediateContexts, &ActionContext{
 				Name:        action.Name,
 				Description: action.Description,
 				Error:       err.Error(),
 			})
-			return err
+			return false, err
 		}
 
-		log.Debug(context, "exit code: %d", exitCode)
-		log.Debug(context, "stdout\n%s", string(stdout))
-		err = ei.ExecContext.Set(string(stdout), ImmediateKey, "stdout")
+		log.Debug(logCtx, "exit code: %d", result.exitCode)
+		log.Debug(logCtx, "stdout\n%s", string(result.stdout))
+		log.Debug(logCtx, "stderr\n%s", string(result.stderr))
+		err = ei.ExecContext.Set(string(result.stdout), ImmediateKey, "stdout")
 		if err != nil {
-			return err
+			return false, err
 		}
-		err = ei.ExecContext.Set(exitCode, ImmediateKey, "exitCode")
+		err = ei.ExecContext.Set(string(result.stderr), ImmediateKey, "stderr")
 		if err != nil {
-			return err
+			return false, err
+		}
+		err = ei.ExecContext.Set(result.exitCode, ImmediateKey, "exitCode")
+		if err != nil {
+			return false, err
 		}
 
 		if ei.config.Debug {
 			jBytes, err := json.Marshal(ei.ExecContext.GetMapping(ImmediateKey))
 			if err != nil {
-				return fmt.Errorf("unable to export immediate context: %w", err)
+				return false, fmt.Errorf("unable to export immediate context: %w", err)
 			}
 			ei.ImmediateContexts = append(ei.ImmediateContexts, &ActionContext{
 				Name:        action.Name,
@@ -541,42 +1427,47 @@ func (ei *ExecutionInstance) Execute(action *Action) error {
 			})
 		}
 
-		if exitCode == 0 {
+		if ei.config.Check && action.executesOnHost() {
+			// nothing was executed, so there is no output to process or condition to wait upon
+			break
+		}
+
+		if result.exitCode == 0 {
 			if action.ParseJson {
 				jsonMap := map[string]any{}
-				err = json.Unmarshal(stdout, &jsonMap)
+				err = json.Unmarshal(result.stdout, &jsonMap)
 				if err != nil {
-					return fmt.Errorf("unable to unmarshal json from stdout: %w", err)
+					return false, fmt.Errorf("unable to unmarshal json from stdout: %w", err)
 				}
 				err = ei.ExecContext.Set(jsonMap, ImmediateKey, "json")
 				if err != nil {
-					return err
+					return false, err
 				}
 			}
 
 			if action.ParseYaml {
 				yamlMap := map[string]any{}
-				err = yaml.Unmarshal(stdout, &yamlMap)
+				err = yaml.Unmarshal(result.stdout, &yamlMap)
 				if err != nil {
-					return fmt.Errorf("unable to unmarshal yaml from stdout: %w", err)
+					return false, fmt.Errorf("unable to unmarshal yaml from stdout: %w", err)
 				}
 				err = ei.ExecContext.Set(yamlMap, ImmediateKey, "yaml")
 				if err != nil {
-					return err
+					return false, err
 				}
 			}
 
 			if action.PostProcess != "" {
 				postProcess, err := eval.Evaluate(action.PostProcess, ei.variableLookup, functions.Call)
 				if err != nil {
-					return fmt.Errorf("unable to evaluate postprocess expression: %w", err)
+					return false, fmt.Errorf("unable to evaluate postprocess expression: %w", err)
 				}
 
 				err = ei.ExecContext.Set(postProcess, ImmediateKey, "postProcess")
 				if err != nil {
-					return err
+					return false, err
 				}
-				log.Debug(context, "postprocess: %s", fmt.Sprintf("%v", postProcess))
+				log.Debug(logCtx, "postprocess: %s", fmt.Sprintf("%v", postProcess))
 			}
 		}
 
@@ -586,50 +1477,80 @@ func (ei *ExecutionInstance) Execute(action *Action) error {
 
 		untilResult, err := eval.Evaluate(action.Until.Condition, ei.variableLookup, functions.Call)
 		if err != nil {
-			return fmt.Errorf("unable to evaluate until condition: %w", err)
+			return false, fmt.Errorf("unable to evaluate until condition: %w", err)
 		}
 		if eval.IsTruthy(untilResult) {
 			break
 		}
 
 		untilAttempts++
-		if untilAttempts >= action.Until.MaxAttempts {
-			return fmt.Errorf("maximum number of attempts occurred and until clause requirement was not met")
+		if action.Until.exhausted(untilAttempts) {
+			return false, fmt.Errorf("maximum number of attempts occurred and until clause requirement was not met")
+		}
+
+		interval := action.Until.interval(untilAttempts)
+		log.Info(logCtx, "until condition not met after %d attempt(s), retrying in %s", untilAttempts, interval)
+		err = sleep(ctx, interval.Seconds())
+		if err != nil {
+			return false, fmt.Errorf("until clause requirement was not met\n%w", err)
 		}
 	}
 
-	if exitCode != 0 {
+	if result.exitCode != 0 {
 		if !action.IgnoreExitCode {
-			return cmdsession.NewExitCodeError(exitCode)
+			return false, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr)
 		}
 	}
 
-	if action.FailWhen != "" {
+	// conditions are only evaluated against real output, which is never produced in check mode
+	evaluateConditions := !ei.config.Check || !action.executesOnHost()
+
+	if action.FailWhen != "" && evaluateConditions {
 		failWhenResult, err := eval.Evaluate(action.FailWhen, ei.variableLookup, functions.Call)
 		if err != nil {
-			return fmt.Errorf("unable to evaluate failWhen condition %s: %w", action.FailWhen, err)
+			return false, fmt.Errorf("unable to evaluate failWhen condition %s: %w", action.FailWhen, err)
 		}
 
 		if eval.IsTruthy(failWhenResult) {
-			return fmt.Errorf("condition of failWhen clause evaluated to true")
+			return false, fmt.Errorf("condition of failWhen clause evaluated to true")
 		}
 	}
 
+	changed := result.changed
+	if action.ChangedWhen != "" && evaluateConditions {
+		changedWhenResult, err := eval.Evaluate(action.ChangedWhen, ei.variableLookup, functions.Call)
+		if err != nil {
+			return false, fmt.Errorf("unable to evaluate changedWhen condition %s: %w", action.ChangedWhen, err)
+		}
+
+		changed = eval.IsTruthy(changedWhenResult)
+	}
+	err = ei.ExecContext.Set(changed, ImmediateKey, "changed")
+	if err != nil {
+		return false, err
+	}
+	if changed {
+		log.Info(logCtx, "changed")
+	}
+
 	// at this point it is safe to propagate all transient data to the context, if context names exist
 	if action.Name != "" {
 		actionLocalNamespace := action.Name
 		err = ei.ExecContext.Set(ei.ExecContext.GetMapping(ImmediateKey), actionLocalNamespace)
 		if err != nil {
-			return fmt.Errorf("unable to set fully local context data on store: %w", err)
+			return false, fmt.Errorf("unable to set fully local context data on store: %w", err)
 		}
 	}
 
 	if action.Pause != nil && action.Pause.After > 0 {
-		log.Debug(context, "pausing after action execution for %0.2f seconds", action.Pause.After)
-		time.Sleep(time.Second * time.Duration(action.Pause.After))
+		log.Debug(logCtx, "pausing after action execution for %0.2f seconds", action.Pause.After)
+		err = sleep(ctx, action.Pause.After)
+		if err != nil {
+			return false, err
+		}
 	}
 
-	return nil
+	return changed, nil
 }
 
 func (ei *ExecutionInstance) getSuUser(action *Action) (string, error) {
@@ -640,79 +1561,121 @@ func (ei *ExecutionInstance) getSuUser(action *Action) (string, error) {
 	return render.ToString(result), nil
 }
 
-func (ei *ExecutionInstance) getExecString(action *Action) ([]string, error) {
-	var renderedExec []string
-	for _, ex := range action.Exec {
-		rendEx, err := render.Render(ex, ei.variableLookup, functions.Call)
+// environment prefixes a command so that it executes with the environment variables and in the working directory of
+// the action, when the action requires it
+func (ei *ExecutionInstance) environment(action *Action, cmd []string) ([]string, error) {
+	if action.Chdir != "" {
+		dir, err := render.Render(action.Chdir, ei.variableLookup, functions.Call)
 		if err != nil {
-			return nil, fmt.Errorf("unable to template action exec command portion: %w", err)
+			return nil, fmt.Errorf("unable to evaluate action chdir: %w", err)
 		}
-		renderedExec = append(renderedExec, render.ToString(rendEx))
+		cmd = append([]string{ei.config.Executor.ShellBinary, "-c", chdirScript, render.ToString(dir)}, cmd...)
 	}
 
-	if !action.Sudo && action.Su == "" {
-		return renderedExec, nil
+	if len(action.Env) > 0 {
+		keys := make([]string, 0, len(action.Env))
+		for k := range action.Env {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		prefix := []string{"env"}
+		for _, k := range keys {
+			v, err := render.Render(action.Env[k], ei.variableLookup, functions.Call)
+			if err != nil {
+				return nil, fmt.Errorf("unable to evaluate action env value at key \"%s\": %w", k, err)
+			}
+			prefix = append(prefix, fmt.Sprintf("%s=%s", k, render.ToString(v)))
+		}
+		cmd = append(prefix, cmd...)
 	}
 
+	return cmd, nil
+}
+
+// privileged prefixes a command so that it executes as root or as the su user, when the action requires it
+func (ei *ExecutionInstance) privileged(action *Action, cmd []string) ([]string, error) {
 	if action.Sudo {
 		if ei.config.SudoPrompt {
-			renderedExec = append([]string{"sudo", "-S"}, renderedExec...)
-		} else {
-			renderedExec = append([]string{"sudo"}, renderedExec...)
+			return append([]string{"sudo", "-S"}, cmd...), nil
 		}
-	} else if action.Su != "" {
+		return append([]string{"sudo"}, cmd...), nil
+	}
+
+	if action.Su != "" {
 		suUser, err := ei.getSuUser(action)
 		if err != nil {
 			return nil, err
 		}
 		if ei.config.SudoPrompt {
-			renderedExec = append([]string{"sudo", "-S", "-H", "-u", suUser}, renderedExec...)
-		} else {
-			renderedExec = append([]string{"sudo", "-H", "-u", suUser}, renderedExec...)
+			return append([]string{"sudo", "-S", "-H", "-u", suUser}, cmd...), nil
 		}
+		return append([]string{"sudo", "-H", "-u", suUser}, cmd...), nil
 	}
 
-	return renderedExec, nil
+	return cmd, nil
 }
 
-func (ei *ExecutionInstance) getShellString(action *Action) ([]string, error) {
-	var renderedExec []string
-	rendEx, err := render.Render(action.Shell, ei.variableLookup, functions.Call)
+// renderString renders a templated property of an action, described by what in the event of an error
+func (ei *ExecutionInstance) renderString(what string, value string) (string, error) {
+	rendered, err := render.Render(value, ei.variableLookup, functions.Call)
 	if err != nil {
-		return nil, fmt.Errorf("unable to template action shell command portion: %w", err)
+		return "", fmt.Errorf("unable to evaluate %s: %w", what, err)
 	}
 
-	combined := utils.Combine(render.ToString(rendEx))
+	return render.ToString(rendered), nil
+}
 
-	if !action.Sudo && action.Su == "" {
-		return []string{ei.config.Executor.ShellBinary, "-c", combined}, nil
-	}
-	if action.Sudo {
-		if ei.config.SudoPrompt {
-			renderedExec = []string{"sudo", "-S", ei.config.Executor.ShellBinary, "-c", combined}
-		} else {
-			renderedExec = []string{"sudo", ei.config.Executor.ShellBinary, "-c", combined}
-		}
-	} else if action.Su != "" {
-		suUser, err := ei.getSuUser(action)
+// renderStrings renders each of a list of templated properties of an action
+func (ei *ExecutionInstance) renderStrings(what string, values []string) ([]string, error) {
+	var rendered []string
+	for _, value := range values {
+		r, err := ei.renderString(what, value)
 		if err != nil {
 			return nil, err
 		}
-		if ei.config.SudoPrompt {
-			renderedExec = []string{"sudo", "-S", "-H", "-u", suUser, ei.config.Executor.ShellBinary, "-c", combined}
-		} else {
-			renderedExec = []string{"sudo", "-H", "-u", suUser, ei.config.Executor.ShellBinary, "-c", combined}
+		rendered = append(rendered, r)
+	}
+
+	return rendered, nil
+}
+
+func (ei *ExecutionInstance) getExecString(action *Action) ([]string, error) {
+	var renderedExec []string
+	for _, ex := range action.Exec {
+		rendEx, err := render.Render(ex, ei.variableLookup, functions.Call)
+		if err != nil {
+			return nil, fmt.Errorf("unable to template action exec command portion: %w", err)
 		}
+		renderedExec = append(renderedExec, render.ToString(rendEx))
+	}
+
+	cmd, err := ei.environment(action, renderedExec)
+	if err != nil {
+		return nil, err
+	}
+	return ei.privileged(action, cmd)
+}
+
+func (ei *ExecutionInstance) getShellString(action *Action) ([]string, error) {
+	rendEx, err := render.Render(action.Shell, ei.variableLookup, functions.Call)
+	if err != nil {
+		return nil, fmt.Errorf("unable to template action shell command portion: %w", err)
 	}
 
-	return renderedExec, nil
+	combined := utils.Combine(render.ToString(rendEx))
+	cmd, err := ei.environment(action, []string{ei.config.Executor.ShellBinary, "-c", combined})
+	if err != nil {
+		return nil, err
+	}
+	return ei.privileged(action, cmd)
 }
 
-// executeSingleAction performs the action execution, returning the output, exit code, and or any error
-func (ei *ExecutionInstance) executeSingleAction(action *Action) ([]byte, int, error) {
+// executeSingleAction performs the action execution, returning the output, exit code and change status, and or any error
+func (ei *ExecutionInstance) executeSingleAction(ctx context.Context, action *Action) (*actionResult, error) {
 	var err error
 	if action.Shell != "" && len(action.Exec) > 0 {
-		return nil, 0, fmt.Errorf("shell and exec directives are mutually exclusive")
+		return nil, fmt.Errorf("shell and exec directives are mutually exclusive")
 	}
 
 	if action.Shell != "" || len(action.Exec) > 0 {
@@ -720,12 +1683,12 @@ func (ei *ExecutionInstance) executeSingleAction(action *Action) ([]byte, int, e
 		if action.Shell != "" {
 			execStr, err = ei.getShellString(action)
 			if err != nil {
-				return nil, 0, err
+				return nil, err
 			}
 		} else if len(action.Exec) > 0 {
 			execStr, err = ei.getExecString(action)
 			if err != nil {
-				return nil, 0, err
+				return nil, err
 			}
 		}
 
@@ -733,7 +1696,7 @@ func (ei *ExecutionInstance) executeSingleAction(action *Action) ([]byte, int, e
 		if action.Stdin != "" {
 			stdin, err := render.Render(action.Stdin, ei.variableLookup, functions.Call)
 			if err != nil {
-				return nil, 0, fmt.Errorf("unable to evaluate action stdin")
+				return nil, fmt.Errorf("unable to evaluate action stdin")
 			}
 
 			switch t := stdin.(type) {
@@ -742,136 +1705,255 @@ func (ei *ExecutionInstance) executeSingleAction(action *Action) ([]byte, int, e
 			case string:
 				reader = strings.NewReader(t)
 			default:
-				return nil, 0, fmt.Errorf("action stdin must evaluate to a string or byte array (it is currently %T)", t)
+				return nil, fmt.Errorf("action stdin must evaluate to a string or byte array (it is currently %T)", t)
 			}
 		}
-		var execClient cmdsession.ExecutionClient
-		if action.Local {
-			execClient = ei.localExecutionClient
-		} else {
-			execClient = ei.executionClient
+		if ei.config.Check {
+			ei.addPlan(action, &PlannedAction{
+				Command: execStr,
+			})
+			log.Info([]any{"host", ei.hostIdent}, "check mode, would execute: %s", utils.Quote(execStr...))
+			return &actionResult{changed: true}, nil
+		}
+
+		result, err := ei.executeCommand(ctx, ei.clientFor(action), reader, execStr, action.Stream || ei.config.Stream)
+		if err != nil {
+			return nil, err
 		}
-		return ei.executeRemoteCommand(execClient, reader, execStr)
+
+		// commands are opaque, so having run one is assumed to have changed something unless changedWhen says otherwise
+		result.changed = true
+		return result, nil
 	}
 
 	// if the code gets to this point, it's a sync
 	if action.Sync != nil {
-		return nil, 0, ei.sync(action)
+		return ei.sync(ctx, action)
 	}
 
 	if action.Template != nil {
-		return ei.template(action)
+		return ei.template(ctx, action)
+	}
+
+	if action.Fetch != nil {
+		return ei.fetch(ctx, action)
+	}
+
+	if action.WaitFor != nil {
+		return ei.waitFor(ctx, action)
+	}
+
+	if action.File != nil {
+		return ei.file(ctx, action)
+	}
+
+	if action.LineInFile != nil {
+		return ei.lineInFile(ctx, action)
+	}
+
+	if action.BlockInFile != nil {
+		return ei.blockInFile(ctx, action)
+	}
+
+	if action.Copy != nil {
+		return ei.copy(ctx, action)
+	}
+
+	if action.Package != nil {
+		return ei.pkg(ctx, action)
+	}
+
+	if action.Service != nil {
+		return ei.service(ctx, action)
+	}
+
+	if action.User != nil {
+		return ei.user(ctx, action)
+	}
+
+	if action.Group != nil {
+		return ei.group(ctx, action)
+	}
+
+	if action.Unarchive != nil {
+		return ei.unarchive(ctx, action)
+	}
+
+	if action.Archive != nil {
+		return ei.archive(ctx, action)
+	}
+
+	if action.Download != nil {
+		return ei.download(ctx, action)
+	}
+
+	if len(action.Assert) > 0 {
+		return ei.assert(action)
+	}
+
+	if action.Debug != nil {
+		return ei.debug(action)
+	}
+
+	if len(action.Set) > 0 {
+		return ei.setValues(action)
+	}
+
+	return &actionResult{}, nil
+}
+
+// clientFor provides the execution client the action runs against, which is the local machine for local actions
+func (ei *ExecutionInstance) clientFor(action *Action) cmdsession.ExecutionClient {
+	if action.Local {
+		return ei.localExecutionClient
 	}
 
-	return nil, 0, nil
+	return ei.executionClient
+}
+
+// addPlan records the planned work of an action while in check mode
+func (ei *ExecutionInstance) addPlan(action *Action, plan *PlannedAction) {
+	plan.Description = action.Description
+	plan.Type = action.Type()
+	plan.Local = action.Local
+	ei.Plan = append(ei.Plan, plan)
 }
 
-func (ei *ExecutionInstance) executeRemoteCommand(execClient cmdsession.ExecutionClient, stdin io.Reader, cmd []string) ([]byte, int, error) {
+func (ei *ExecutionInstance) executeRemoteCommand(ctx context.Context, execClient cmdsession.ExecutionClient, stdin io.Reader, cmd []string) (*actionResult, error) {
+	return ei.executeCommand(ctx, execClient, stdin, cmd, false)
+}
+
+// executeCommand executes the command, logging its output line by line as it arrives when streaming
+func (ei *ExecutionInstance) executeCommand(ctx context.Context, execClient cmdsession.ExecutionClient, stdin io.Reader, cmd []string, stream bool) (*actionResult, error) {
+	// the password is only fed to commands which are run through sudo, otherwise it would be consumed as regular input
+	if ei.config.SudoPrompt && len(cmd) > 0 && cmd[0] == "sudo" {
+		pass := ei.config.GetSudoPass()
+		if pass == "" {
+			fmt.Printf("enter your remote user password: ")
+			bytePassword, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Printf("\n")
+			if err != nil {
+				return nil, err
+			}
+			pass = strings.Trim(string(bytePassword), "\n")
+			ei.config.SetSudoPass(pass)
+		}
+
+		if stdin != nil {
+			inBytes, err := io.ReadAll(stdin)
+			if err != nil {
+				return nil, err
+			}
+
+			inBytes = append([]byte(pass+"\n"), inBytes...)
+			stdin = bytes.NewReader(inBytes)
+		} else {
+			stdin = bytes.NewReader([]byte(pass + "\n"))
+		}
+	}
+
 	// create a new command session
-	var output []byte
+	var output, errOutput []byte
 	attempts := 0
 	for {
 		sess, err := execClient.NewCmdSession()
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
 
-		if ei.config.SudoPrompt {
-			pass := ei.config.GetSudoPass()
-			if pass == "" {
-				fmt.Printf("enter your remote user password: ")
-				bytePassword, err := term.ReadPassword(int(os.Stdin.Fd()))
-				fmt.Printf("\n")
-				if err != nil {
-					return nil, 0, err
-				}
-				pass = strings.Trim(string(bytePassword), "\n")
-				ei.config.SetSudoPass(pass)
-			}
-
-			if stdin != nil {
-				inBytes, err := io.ReadAll(stdin)
-				if err != nil {
-					return nil, 0, err
-				}
-
-				inBytes = append([]byte(pass+"\n"), inBytes...)
-				stdin = bytes.NewReader(inBytes)
-			} else {
-				stdin = bytes.NewReader([]byte(pass + "\n"))
-			}
+		var stdout, stderr *log.LineWriter
+		if stream {
+			stdout = log.NewLineWriter(log.INFO, []any{"host", ei.hostIdent, "stream", "stdout"})
+			stderr = log.NewLineWriter(log.INFO, []any{"host", ei.hostIdent, "stream", "stderr"})
+			sess.SetOutputStreams(stdout, stderr)
 		}
 
-		output, err = sess.Execute(stdin, cmd...)
+		output, errOutput, err = sess.Execute(ctx, stdin, cmd...)
+		if stream {
+			// flush any final partial line of this attempt before anything else is logged
+			_ = stdout.Close()
+			_ = stderr.Close()
+		}
 		if err != nil {
-			_, ok := err.(*cmdsession.SessionError)
+			sessionErr, ok := err.(*cmdsession.SessionError)
 			if ok {
 				log.Debug(nil, "waiting %0.2f seconds before attempting SSH retry after failure", ei.config.Executor.Ssh.DelayAfterConnectionFailure)
 				_ = execClient.Close()
 				for {
-					err = execClient.Connect()
+					attempts++
+					err = execClient.Connect(ctx)
 					if err != nil {
 						log.Debug(nil, "%s", err.Error())
-						attempts++
 						if attempts >= ei.config.Executor.Ssh.MaxConnectionAttempts {
-							return nil, 0, err
+							return nil, err
 						}
 
-						time.Sleep(time.Duration(ei.config.Executor.Ssh.DelayAfterConnectionFailure) * time.Second)
+						if sleepErr := sleep(ctx, ei.config.Executor.Ssh.DelayAfterConnectionFailure); sleepErr != nil {
+							return nil, sleepErr
+						}
 						continue
 					}
 					break
 				}
+				if attempts >= ei.config.Executor.Ssh.MaxConnectionAttempts {
+					return nil, sessionErr
+				}
+
+				// once reconnected the command is run again, provided its input can be replayed from the start
+				if stdin != nil {
+					seeker, ok := stdin.(io.Seeker)
+					if !ok {
+						return nil, fmt.Errorf("unable to run %s again after reconnecting, its input cannot be replayed: %w", cmd[0], sessionErr)
+					}
+					if _, err := seeker.Seek(0, io.SeekStart); err != nil {
+						return nil, fmt.Errorf("unable to replay the input of %s after reconnecting: %w", cmd[0], err)
+					}
+				}
+				continue
 			}
 
 			exitCode, hasExitCode := cmdsession.GetExitCode(err)
 			if !hasExitCode {
-				return nil, 0, err
+				return nil, err
 			}
 
-			return output, exitCode, nil
+			return &actionResult{stdout: output, stderr: errOutput, exitCode: exitCode}, nil
 		}
 
-		return output, 0, nil
+		return &actionResult{stdout: output, stderr: errOutput}, nil
 	}
 }
 
-func (ei *ExecutionInstance) sync(action *Action) error {
-	syncAction := action.Sync
-
-	return ssh.Rsync(ei.config.Username(ei.hostIdent), ei.config.Hostname(ei.hostIdent), ei.config.Port(ei.hostIdent), ei.config.KeyPath(ei.hostIdent), syncAction.Src, syncAction.Dest)
-}
-
 // template causes the templatization of a local resource and renders it to a remote location
-func (ei *ExecutionInstance) template(action *Action) ([]byte, int, error) {
+func (ei *ExecutionInstance) template(ctx context.Context, action *Action) (*actionResult, error) {
 	var err error
 	templateAction := action.Template
 
 	src := templateAction.Src
 	srcAny, err := render.Render(src, ei.variableLookup, functions.Call)
 	if err != nil {
-		return nil, 0, fmt.Errorf("unable to evaluate template src: %w", err)
+		return nil, fmt.Errorf("unable to evaluate template src: %w", err)
 	}
 	src = render.ToString(srcAny)
 
 	dest := templateAction.Dest
 	destAny, err := render.Render(dest, ei.variableLookup, functions.Call)
 	if err != nil {
-		return nil, 0, fmt.Errorf("unable to evaluate template dest: %w", err)
+		return nil, fmt.Errorf("unable to evaluate template dest: %w", err)
 	}
 	dest = render.ToString(destAny)
 
 	if !filepath.IsAbs(src) {
 		p, err := filepath.Abs(filepath.Join(ei.config.CwdPath, src))
 		if err != nil {
-			return nil, 0, fmt.Errorf("unable to transform template path %s to abs path: %w", src, err)
+			return nil, fmt.Errorf("unable to transform template path %s to abs path: %w", src, err)
 		}
 
 		src = p
 	}
 	t, err := template.ParseFiles(src)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
 	var rendered bytes.Buffer
@@ -879,38 +1961,58 @@ func (ei *ExecutionInstance) template(action *Action) ([]byte, int, error) {
 	for k, v := range templateAction.Context {
 		evalV, err := render.Render(v, ei.variableLookup, functions.Call)
 		if err != nil {
-			return nil, 0, fmt.Errorf("problem evaluating value \"%s\" at key \"%s\"", v, k)
+			return nil, fmt.Errorf("problem evaluating value \"%s\" at key \"%s\"", v, k)
 		}
 
 		evalContext[k] = evalV
 	}
 	err = t.Execute(&rendered, evalContext)
 	if err != nil {
-		return nil, 0, err
+		return nil, err
 	}
 
-	var execStr []string
-	shellStr := utils.Combine(fmt.Sprintf("cat > %s", dest))
-	if action.Sudo {
-		if ei.config.SudoPrompt {
-			execStr = []string{"sudo", "-S", ei.config.Executor.ShellBinary, "-c", shellStr}
-		} else {
-			execStr = []string{"sudo", ei.config.Executor.ShellBinary, "-c", shellStr}
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+	current, exists, err := ei.readRemoteFile(ctx, action, ei.executionClient, dest)
+	if err != nil {
+		return nil, err
+	}
+	if exists && bytes.Equal(current, rendered.Bytes()) {
+		log.Info(logCtx, "template %s is unchanged, skipping write", dest)
+		return &actionResult{}, nil
+	}
+
+	var diff string
+	if ei.config.Diff {
+		diff, err = utils.UnifiedDiff(current, rendered.Bytes(), dest)
+		if err != nil {
+			return nil, fmt.Errorf("unable to compute template diff for %s: %w", dest, err)
 		}
-	} else if action.Su != "" {
-		suUser, err := ei.getSuUser(action)
+		log.Info(logCtx, "template diff\n%s", diff)
+		err = ei.ExecContext.Set(diff, ImmediateKey, "diff")
 		if err != nil {
-			return nil, 0, err
+			return nil, err
 		}
+	}
 
-		if ei.config.SudoPrompt {
-			execStr = []string{"sudo", "-S", "-H", "-u", suUser, ei.config.Executor.ShellBinary, "-c", shellStr}
-		} else {
-			execStr = []string{"sudo", "-S", "-H", "-u", suUser, ei.config.Executor.ShellBinary, "-c", shellStr}
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Src:     src,
+			Dest:    dest,
+			Content: rendered.String(),
+			Diff:    diff,
+		})
+		if !ei.config.Diff {
+			log.Info(logCtx, "check mode, would render template %s to %s\n%s", src, dest, rendered.String())
 		}
-	} else {
-		execStr = []string{ei.config.Executor.ShellBinary, "-c", shellStr}
+		return &actionResult{changed: true}, nil
 	}
 
-	return ei.executeRemoteCommand(ei.executionClient, &rendered, execStr)
+	result, err := ei.writeRemoteFile(ctx, action, ei.executionClient, dest, rendered.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	result.changed = result.exitCode == 0
+	return result, nil
 }
@@ -1,10 +1,19 @@
 package sequence
 
 import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/frozengoats/crucible/internal/cmdsession"
 	"github.com/frozengoats/crucible/internal/config"
+	"github.com/frozengoats/kvstore"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -63,6 +72,7 @@ func TestSequenceIteration(t *testing.T) {
 			Hosts: map[string]*config.HostConfig{
 				"testhost": {},
 			},
+			Executor: config.Executor{FactsPath: t.TempDir()},
 		},
 		"testhost",
 	)
@@ -86,3 +96,602 @@ func TestSequenceIteration(t *testing.T) {
 	assert.Equal(t, 6, totalActions)
 	assert.False(t, exInst.HasMore())
 }
+
+func TestCheckModePlansWithoutExecuting(t *testing.T) {
+	seq := &Sequence{
+		Description: "check mode",
+		Sequence: []*Action{
+			{
+				Description: "iterated shell",
+				Iterate:     ".Values.items",
+				Action: &Action{
+					Shell: "echo <!! .item !!>",
+				},
+			},
+			{
+				Description: "skipped shell",
+				When:        "1 == 2",
+				Shell:       "echo skipped",
+			},
+			{
+				Description: "exec with sudo",
+				Sudo:        true,
+				Exec:        []string{"touch", "/tmp/file"},
+				ParseJson:   true,
+				FailWhen:    ".stdout != \"never\"",
+			},
+		},
+	}
+
+	values, err := kvstore.FromMapping(map[string]any{"items": []any{"a", "b"}})
+	assert.NoError(t, err)
+
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+		ValuesStore: values,
+		Check:       true,
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewDummyExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+
+	for {
+		action, err := exInst.Next()
+		assert.NoError(t, err)
+		if action == nil {
+			break
+		}
+		assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+		assert.NoError(t, exInst.Execute(context.Background(), action))
+	}
+
+	assert.Len(t, exInst.Plan, 3)
+	assert.Equal(t, []string{"sh", "-c", "echo a"}, exInst.Plan[0].Command)
+	assert.Equal(t, []string{"sh", "-c", "echo b"}, exInst.Plan[1].Command)
+	assert.Equal(t, "exec", exInst.Plan[2].Type)
+	assert.Equal(t, []string{"sudo", "touch", "/tmp/file"}, exInst.Plan[2].Command)
+	assert.Equal(t, ActionStats{Changed: 3, Skipped: 1}, exInst.Stats)
+}
+
+func TestTemplateSkipsIdenticalContentAndDiffs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "template.txt")
+	dest := filepath.Join(dir, "rendered.txt")
+	assert.NoError(t, os.WriteFile(src, []byte("name: {{ .name }}\n"), 0o644))
+
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+		Diff: true,
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+
+	action := &Action{
+		Description: "render",
+		Template: &Template{
+			Src:     src,
+			Dest:    dest,
+			Context: map[string]string{"name": "first"},
+		},
+	}
+	seq := &Sequence{Sequence: []*Action{action}}
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+	_, err = exInst.Next()
+	assert.NoError(t, err)
+
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+	content, err := os.ReadFile(dest)
+	assert.NoError(t, err)
+	assert.Equal(t, "name: first\n", string(content))
+	assert.Contains(t, exInst.ExecContext.GetString(ImmediateKey, "diff"), "+name: first")
+	assert.True(t, exInst.ExecContext.GetBool(ImmediateKey, "changed"))
+
+	// identical content must not be rewritten
+	assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+	assert.False(t, exInst.ExecContext.Exists(ImmediateKey, "diff"))
+	assert.False(t, exInst.ExecContext.GetBool(ImmediateKey, "changed"))
+
+	action.Template.Context["name"] = "second"
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+	diff := exInst.ExecContext.GetString(ImmediateKey, "diff")
+	assert.Contains(t, diff, "-name: first")
+	assert.Contains(t, diff, "+name: second")
+}
+
+func TestChangedWhen(t *testing.T) {
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+
+	seq := &Sequence{
+		Sequence: []*Action{
+			{
+				Name:        "unchanged",
+				Shell:       "echo present",
+				ChangedWhen: "line(.stdout) != 'present'",
+			},
+			{
+				Name:  "changed",
+				Shell: "echo installed",
+			},
+		},
+	}
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+
+	for {
+		action, err := exInst.Next()
+		assert.NoError(t, err)
+		if action == nil {
+			break
+		}
+		assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+		assert.NoError(t, exInst.Execute(context.Background(), action))
+	}
+
+	assert.False(t, exInst.ExecContext.GetBool("unchanged", "changed"))
+	assert.True(t, exInst.ExecContext.GetBool("changed", "changed"))
+	assert.Equal(t, ActionStats{Ok: 1, Changed: 1}, exInst.Stats)
+}
+
+func TestStreamedOutputIsStillCaptured(t *testing.T) {
+	seq := &Sequence{
+		Sequence: []*Action{
+			{
+				Name:   "streamed",
+				Shell:  "echo first; echo second >&2; echo third",
+				Stream: true,
+			},
+		},
+	}
+
+	exInst, executed, err := runSequence(t, seq)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"streamed"}, executed)
+	assert.Equal(t, "first\nthird\n", exInst.ExecContext.GetString("streamed", "stdout"))
+}
+
+func TestStderrIsCaptured(t *testing.T) {
+	seq := &Sequence{
+		Sequence: []*Action{
+			{
+				Name:           "ignored",
+				Shell:          "echo warning >&2; exit 1",
+				IgnoreExitCode: true,
+			},
+			{
+				Name:  "fails",
+				Shell: "echo 'unable to locate package' >&2; exit 100",
+			},
+		},
+	}
+
+	exInst, executed, err := runSequence(t, seq)
+	assert.Equal(t, []string{"ignored"}, executed)
+	assert.Equal(t, "warning\n", exInst.ExecContext.GetString("ignored", "stderr"))
+	assert.EqualError(t, err, "exited with a status of 100\nunable to locate package")
+}
+
+func TestEnvAndChdir(t *testing.T) {
+	dir := t.TempDir()
+	seq := &Sequence{
+		Sequence: []*Action{
+			{
+				Name:  "shell",
+				Shell: "echo \"$GREETING $NAME\" && pwd",
+				Env: map[string]string{
+					"GREETING": "hello there",
+					"NAME":     "<!! .Context.name !!>",
+				},
+				Chdir: dir,
+			},
+			{
+				Name:  "exec",
+				Exec:  []string{"pwd"},
+				Chdir: "<!! .Context.dir !!>",
+			},
+		},
+	}
+	for _, action := range seq.Sequence {
+		assert.NoError(t, action.Validate())
+	}
+
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+
+	for {
+		action, err := exInst.Next()
+		assert.NoError(t, err)
+		if action == nil {
+			break
+		}
+		assert.NoError(t, exInst.ExecContext.Set("world", "name"))
+		assert.NoError(t, exInst.ExecContext.Set(dir, "dir"))
+		assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+		assert.NoError(t, exInst.Execute(context.Background(), action))
+	}
+
+	assert.Equal(t, "hello there world\n"+dir+"\n", exInst.ExecContext.GetString("shell", "stdout"))
+	assert.Equal(t, dir+"\n", exInst.ExecContext.GetString("exec", "stdout"))
+
+	invalid := &Action{Shell: "true", Env: map[string]string{"NOT-VALID": "x"}}
+	assert.Error(t, invalid.Validate())
+}
+
+func TestNotifiedHandlersRunOnceAtEndOfSequence(t *testing.T) {
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+
+	seq := &Sequence{
+		Sequence: []*Action{
+			{Name: "first", Shell: "echo first", Notify: []string{"restart"}},
+			{Name: "second", Shell: "echo second", Notify: []string{"restart"}},
+			{Name: "third", Shell: "echo third", ChangedWhen: "1 == 2", Notify: []string{"reload"}},
+			{
+				Name: "sub",
+				SubSequence: &Sequence{
+					Sequence: []*Action{
+						{Name: "inner", Shell: "echo inner", Notify: []string{"cleanup"}},
+					},
+				},
+			},
+		},
+		Handlers: []*Action{
+			{Name: "cleanup", Shell: "echo cleanup"},
+			{Name: "reload", Shell: "echo reload"},
+			{Name: "restart", Shell: "echo restart"},
+		},
+	}
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+
+	executed := []string{}
+	for exInst.HasMore() {
+		action, err := exInst.Next()
+		assert.NoError(t, err)
+		if action == nil {
+			break
+		}
+		assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+		assert.NoError(t, exInst.Execute(context.Background(), action))
+		executed = append(executed, action.Name)
+	}
+
+	// the handler notified from within the imported sequence is resolved from the parent, and handlers
+	// run in the order in which they are declared
+	assert.Equal(t, []string{"first", "second", "third", "inner", "cleanup", "restart"}, executed)
+	assert.False(t, exInst.HasMore())
+}
+
+func TestNotifiedBlockHandlerCountsEveryStep(t *testing.T) {
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+
+	seq := &Sequence{
+		Sequence: []*Action{
+			{Name: "deploy", Shell: "echo deploy", Notify: []string{"restart"}},
+		},
+		Handlers: []*Action{
+			{
+				Name: "restart",
+				Block: []*Action{
+					{Name: "stop", Shell: "echo stop"},
+					{Name: "start", Shell: "echo start"},
+				},
+			},
+		},
+	}
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+
+	executed := []string{}
+	for exInst.HasMore() {
+		action, err := exInst.Next()
+		assert.NoError(t, err)
+		if action == nil {
+			break
+		}
+		assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+		assert.NoError(t, exInst.Execute(context.Background(), action))
+		executed = append(executed, action.Name)
+	}
+
+	assert.Equal(t, []string{"deploy", "stop", "start"}, executed)
+	assert.False(t, exInst.HasMore())
+}
+
+// runSequence drives an execution instance the same way the executor does, returning the names of the
+// actions which executed successfully and any terminal error
+func runSequence(t *testing.T, seq *Sequence) (*ExecutionInstance, []string, error) {
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+
+	executed := []string{}
+	for {
+		action, err := exInst.Next()
+		if err != nil {
+			return exInst, executed, err
+		}
+		if action == nil {
+			return exInst, executed, nil
+		}
+
+		assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+		err = exInst.Execute(context.Background(), action)
+		if err != nil {
+			if !exInst.Rescue(err) {
+				return exInst, executed, err
+			}
+			continue
+		}
+		executed = append(executed, action.Name)
+	}
+}
+
+func TestBlockRescueAndAlways(t *testing.T) {
+	seq := &Sequence{
+		Sequence: []*Action{
+			{
+				Description: "block first",
+				Block: []*Action{
+					{Name: "one", Shell: "echo one"},
+					{Name: "fails", Shell: "exit 3"},
+					{Name: "never", Shell: "echo never"},
+				},
+				Rescue: []*Action{
+					{Name: "rollback", Shell: "echo rollback", FailWhen: ".Context.failure.error != \"exited with a status of 3\""},
+				},
+				Always: []*Action{
+					{Name: "cleanup", Shell: "echo cleanup"},
+				},
+			},
+			{Name: "after", Shell: "echo after"},
+		},
+	}
+
+	exInst, executed, err := runSequence(t, seq)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"one", "rollback", "cleanup", "after"}, executed)
+	assert.Equal(t, 1, exInst.Stats.Rescued)
+	assert.Equal(t, 1, exInst.Stats.Failed)
+	assert.False(t, exInst.HasMore())
+}
+
+func TestBlockAlwaysRunsBeforeFailing(t *testing.T) {
+	seq := &Sequence{
+		Sequence: []*Action{
+			{Name: "before", Shell: "echo before"},
+			{
+				Description: "outer",
+				Block: []*Action{
+					{
+						Description: "inner",
+						Block: []*Action{
+							{Name: "fails", Shell: "exit 3"},
+						},
+						Always: []*Action{
+							{Name: "inner_always", Shell: "echo inner"},
+						},
+					},
+				},
+				Rescue: []*Action{
+					{Name: "rescue_fails", Shell: "exit 4"},
+				},
+				Always: []*Action{
+					{Name: "outer_always", Shell: "echo outer"},
+				},
+			},
+			{Name: "never", Shell: "echo never"},
+		},
+	}
+
+	_, executed, err := runSequence(t, seq)
+	assert.Error(t, err)
+	code, ok := cmdsession.GetExitCode(err)
+	assert.True(t, ok)
+	assert.Equal(t, 4, code)
+	assert.Equal(t, []string{"before", "inner_always", "outer_always"}, executed)
+}
+
+func TestActionTimeout(t *testing.T) {
+	seq := &Sequence{
+		Sequence: []*Action{
+			{Name: "quick", Shell: "echo quick", Timeout: 5},
+			{Name: "slow", Shell: "sleep 5", Timeout: 0.2},
+			{Name: "never", Shell: "echo never"},
+		},
+	}
+
+	start := time.Now()
+	_, executed, err := runSequence(t, seq)
+	assert.Less(t, time.Since(start), 3*time.Second)
+	assert.True(t, cmdsession.IsTimeoutError(err))
+	assert.EqualError(t, err, "timed out after 200ms")
+	assert.Equal(t, []string{"quick"}, executed)
+}
+
+func TestUntilBackoff(t *testing.T) {
+	until := &Until{PauseInterval: 1, Backoff: 2, MaxInterval: 5}
+	assert.Equal(t, time.Second, until.interval(1))
+	assert.Equal(t, 2*time.Second, until.interval(2))
+	assert.Equal(t, 4*time.Second, until.interval(3))
+	assert.Equal(t, 5*time.Second, until.interval(4))
+
+	until.Jitter = 0.5
+	for range 10 {
+		interval := until.interval(1)
+		assert.GreaterOrEqual(t, interval, 500*time.Millisecond)
+		assert.LessOrEqual(t, interval, 1500*time.Millisecond)
+	}
+
+	counter := filepath.Join(t.TempDir(), "counter")
+	seq := &Sequence{
+		Sequence: []*Action{
+			{
+				Name:           "retried",
+				Shell:          "n=$(cat " + counter + " 2>/dev/null || echo 0); n=$((n+1)); echo $n > " + counter + "; [ $n -ge 3 ]",
+				IgnoreExitCode: true,
+				Until:          &Until{Condition: ".exitCode == 0", PauseInterval: 0.05, Backoff: 2, MaxAttempts: 5},
+			},
+			{
+				Name:           "deadline",
+				Shell:          "exit 1",
+				IgnoreExitCode: true,
+				Until:          &Until{Condition: ".exitCode == 0", PauseInterval: 0.1, Timeout: 0.3},
+			},
+		},
+	}
+	for _, action := range seq.Sequence {
+		assert.NoError(t, action.Validate())
+	}
+
+	start := time.Now()
+	_, executed, err := runSequence(t, seq)
+	assert.Less(t, time.Since(start), 2*time.Second)
+	assert.Equal(t, []string{"retried"}, executed)
+	assert.True(t, cmdsession.IsTimeoutError(err))
+	content, err := os.ReadFile(counter)
+	assert.NoError(t, err)
+	assert.Equal(t, "3\n", string(content))
+
+	invalid := &Action{Shell: "true", Until: &Until{Condition: "true", Backoff: 0.5}}
+	assert.Error(t, invalid.Validate())
+}
+
+func TestActionDeclaringMultipleKindsIsInvalid(t *testing.T) {
+	assert.NoError(t, (&Action{Description: "shell", Shell: "true"}).Validate())
+
+	action := &Action{
+		Description: "ambiguous",
+		Shell:       "true",
+		Fetch:       &Fetch{Src: "/etc/hosts", Dest: "hosts"},
+	}
+	assert.EqualError(t, action.Validate(), "action \"ambiguous\" declares more than one of shell, fetch, only one can be performed")
+
+	action = &Action{
+		Description: "ambiguous",
+		Set:         map[string]any{"x": 1},
+		Assert:      []*Assertion{{Eval: ".Context.x == 1"}},
+	}
+	assert.Error(t, action.Validate())
+}
+
+// flakyClient loses its connection on the first executions, until it has been reconnected, after which every command
+// echoes its input
+type flakyClient struct {
+	failures int
+	connects int
+}
+
+func (c *flakyClient) Connect(ctx context.Context) error {
+	c.connects++
+	return nil
+}
+
+func (c *flakyClient) Close() error {
+	return nil
+}
+
+func (c *flakyClient) NewCmdSession() (cmdsession.CmdSession, error) {
+	return &flakySession{client: c}, nil
+}
+
+func (c *flakyClient) Dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	return nil, fmt.Errorf("unable to dial %s", addr)
+}
+
+type flakySession struct {
+	client *flakyClient
+}
+
+func (s *flakySession) SetOutputStreams(stdout io.Writer, stderr io.Writer) {
+}
+
+func (s *flakySession) Execute(ctx context.Context, stdin io.Reader, cmd ...string) ([]byte, []byte, error) {
+	var input []byte
+	if stdin != nil {
+		input, _ = io.ReadAll(stdin)
+	}
+	if s.client.failures > 0 {
+		s.client.failures--
+		return nil, nil, cmdsession.NewSessionError("connection lost")
+	}
+	return input, nil, nil
+}
+
+func TestCommandRunsAgainAfterReconnecting(t *testing.T) {
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+	cfg.Executor.Ssh.MaxConnectionAttempts = 3
+
+	action := &Action{Description: "flaky", Shell: "true"}
+	client := &flakyClient{failures: 1}
+	seq := &Sequence{Sequence: []*Action{action}}
+	exInst, err := seq.NewExecutionInstance(client, cfg, "testhost")
+	assert.NoError(t, err)
+	_, err = exInst.Next()
+	assert.NoError(t, err)
+
+	assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+	assert.Equal(t, 1, client.connects)
+	assert.Equal(t, 0, exInst.ExecContext.GetInt(ImmediateKey, "exitCode"))
+
+	// input is replayed in full when the command runs again
+	client.failures = 1
+	result, err := exInst.executeRemoteCommand(context.Background(), client, strings.NewReader("replayed"), []string{"cat"})
+	assert.NoError(t, err)
+	assert.Equal(t, "replayed", string(result.stdout))
+
+	// input which cannot be replayed fails the command rather than running it without its input
+	client.failures = 1
+	_, err = exInst.executeRemoteCommand(context.Background(), client, io.MultiReader(strings.NewReader("once")), []string{"cat"})
+	assert.Error(t, err)
+
+	// the command is not run again indefinitely
+	client.failures = 10
+	_, err = exInst.executeRemoteCommand(context.Background(), client, nil, []string{"true"})
+	assert.True(t, cmdsession.IsSessionError(err))
+}
@@ -0,0 +1,208 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+)
+
+const (
+	serviceStateStarted   = "started"
+	serviceStateStopped   = "stopped"
+	serviceStateRestarted = "restarted"
+	serviceStateReloaded  = "reloaded"
+)
+
+// serviceStatusScript detects the init system and prints init|active|enabled for the service named by $0, where active
+// and enabled are 1 or 0
+const serviceStatusScript = `n="$0"; a=0; e=0
+if [ -d /run/systemd/system ] && command -v systemctl >/dev/null 2>&1; then
+	i=systemd
+	if systemctl is-active --quiet "$n"; then a=1; fi
+	if systemctl is-enabled --quiet "$n" 2>/dev/null; then e=1; fi
+elif command -v rc-service >/dev/null 2>&1; then
+	i=openrc
+	if rc-service "$n" status >/dev/null 2>&1; then a=1; fi
+	if rc-update show default 2>/dev/null | cut -d "|" -f 1 | tr -d " " | grep -qxF -- "$n"; then e=1; fi
+elif command -v service >/dev/null 2>&1; then
+	i=sysvinit
+	if service "$n" status >/dev/null 2>&1; then a=1; fi
+	for f in /etc/rc[2345].d/S[0-9][0-9]"$n"; do if [ -e "$f" ]; then e=1; fi; done
+else
+	exit 1
+fi
+echo "$i|$a|$e"`
+
+// sysvEnableScript enables ($1 is enable) or disables the sysvinit service named by $0 using update-rc.d on debian
+// derivatives, and chkconfig elsewhere
+const sysvEnableScript = `if command -v update-rc.d >/dev/null 2>&1; then
+	if [ "$1" = enable ]; then update-rc.d "$0" defaults && update-rc.d "$0" enable; else update-rc.d "$0" disable; fi
+elif [ "$1" = enable ]; then
+	chkconfig "$0" on
+else
+	chkconfig "$0" off
+fi`
+
+// serviceControl produces the command which performs an operation (start, stop, restart, reload, enable or disable) on
+// a service under the given init system
+func (ei *ExecutionInstance) serviceControl(init string, name string, operation string) []string {
+	switch init {
+	case "systemd":
+		return []string{"systemctl", operation, name}
+	case "openrc":
+		switch operation {
+		case "enable":
+			return []string{"rc-update", "add", name, "default"}
+		case "disable":
+			return []string{"rc-update", "del", name, "default"}
+		}
+		return []string{"rc-service", name, operation}
+	default:
+		switch operation {
+		case "enable", "disable":
+			return []string{ei.config.Executor.ShellBinary, "-c", sysvEnableScript, name, operation}
+		}
+		return []string{"service", name, operation}
+	}
+}
+
+func (s *Service) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("a name is required")
+	}
+
+	switch s.State {
+	case "":
+		if s.Enabled == nil {
+			return fmt.Errorf("a state or enabled is required")
+		}
+	case serviceStateStarted, serviceStateStopped, serviceStateRestarted, serviceStateReloaded:
+	default:
+		return fmt.Errorf("state must be one of %s, %s, %s or %s", serviceStateStarted, serviceStateStopped, serviceStateRestarted, serviceStateReloaded)
+	}
+
+	return nil
+}
+
+// service brings a service to the desired state using the init system of the host (systemd, openrc or sysvinit),
+// having first inspected whether it is running and enabled, so that it is only started, stopped or enabled when that
+// differs.  restarted and reloaded always act, although a service which isn't running is started rather than reloaded.
+// the operations performed are stored on the immediate context as .changes and the init system as .init.
+func (ei *ExecutionInstance) service(ctx context.Context, action *Action) (*actionResult, error) {
+	serviceAction := action.Service
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	name, err := ei.renderString("service name", serviceAction.Name)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" {
+		return nil, fmt.Errorf("service name %s evaluates to an empty string", serviceAction.Name)
+	}
+
+	init, active, enabled, err := ei.serviceStatus(ctx, action, name)
+	if err != nil {
+		return nil, err
+	}
+	err = ei.ExecContext.Set(init, ImmediateKey, "init")
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []string
+	switch serviceAction.State {
+	case serviceStateStarted:
+		if !active {
+			operations = append(operations, "start")
+		}
+	case serviceStateStopped:
+		if active {
+			operations = append(operations, "stop")
+		}
+	case serviceStateRestarted:
+		operations = append(operations, "restart")
+	case serviceStateReloaded:
+		if active {
+			operations = append(operations, "reload")
+		} else {
+			operations = append(operations, "start")
+		}
+	}
+	if serviceAction.Enabled != nil && *serviceAction.Enabled != enabled {
+		if *serviceAction.Enabled {
+			operations = append(operations, "enable")
+		} else {
+			operations = append(operations, "disable")
+		}
+	}
+
+	err = ei.ExecContext.Set(operations, ImmediateKey, "changes")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(operations) == 0 {
+		log.Info(logCtx, "service %s is unchanged", name)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Changes: operations,
+		})
+		log.Info(logCtx, "check mode, would change service %s using %s: %s", name, init, strings.Join(operations, ", "))
+		return &actionResult{changed: true}, nil
+	}
+
+	var result *actionResult
+	for _, operation := range operations {
+		cmd, err := ei.privileged(action, ei.serviceControl(init, name, operation))
+		if err != nil {
+			return nil, err
+		}
+
+		result, err = ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("unable to %s service %s: %w", operation, name, err)
+		}
+		if result.exitCode != 0 {
+			return result, nil
+		}
+	}
+
+	log.Info(logCtx, "changed service %s using %s: %s", name, init, strings.Join(operations, ", "))
+	result.changed = true
+	return result, nil
+}
+
+// serviceStatus detects the init system of the host and whether the service is running and enabled under it, with the
+// privileges of the action since the status of some services can only be queried by root
+func (ei *ExecutionInstance) serviceStatus(ctx context.Context, action *Action, name string) (string, bool, bool, error) {
+	cmd, err := ei.privileged(action, []string{ei.config.Executor.ShellBinary, "-c", serviceStatusScript, name})
+	if err != nil {
+		return "", false, false, err
+	}
+
+	result, err := ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, cmd)
+	if err != nil {
+		return "", false, false, fmt.Errorf("unable to inspect service %s: %w", name, err)
+	}
+	if result.exitCode != 0 {
+		if len(result.stderr) > 0 {
+			return "", false, false, fmt.Errorf("unable to inspect service %s: %w", name, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+		}
+		return "", false, false, fmt.Errorf("no supported init system was found, one of systemd, openrc or sysvinit is required")
+	}
+
+	parts := strings.Split(strings.TrimSpace(string(result.stdout)), "|")
+	if len(parts) != 3 {
+		return "", false, false, fmt.Errorf("unexpected service description: %s", result.stdout)
+	}
+
+	return parts[0], parts[1] == "1", parts[2] == "1", nil
+}
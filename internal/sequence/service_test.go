@@ -0,0 +1,135 @@
+package sequence
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeRcService and fakeRcUpdate are stand-ins for openrc, recording their invocations in a log and the state of each
+// service as NAME.running and NAME.enabled files
+const fakeRcService = `#!/bin/sh
+echo "rc-service $@" >> %[1]s/log
+case "$2" in
+status) [ -e %[1]s/$1.running ];;
+start|restart) touch %[1]s/$1.running;;
+stop) rm -f %[1]s/$1.running;;
+reload) [ -e %[1]s/$1.running ];;
+esac
+`
+
+const fakeRcUpdate = `#!/bin/sh
+echo "rc-update $@" >> %[1]s/log
+case "$1" in
+show) for f in %[1]s/*.enabled; do [ -e "$f" ] && echo " $(basename "$f" .enabled) | default"; done; true;;
+add) touch %[1]s/$2.enabled;;
+del) rm -f %[1]s/$2.enabled;;
+esac
+`
+
+// fakeSudo runs the command as is, recording that it was run through sudo
+const fakeSudo = `#!/bin/sh
+touch %[1]s/sudo
+exec "$@"
+`
+
+// serviceHost restricts the PATH to a directory holding fake openrc and sudo commands and the tools the service scripts
+// require, so that openrc is the init system to be found
+func serviceHost(t *testing.T) (func() []string, string) {
+	dir := t.TempDir()
+	for _, tool := range []string{"sh", "grep", "cut", "tr", "touch", "rm", "basename"} {
+		p, err := exec.LookPath(tool)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Symlink(p, filepath.Join(dir, tool)))
+	}
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "rc-service"), []byte(fmt.Sprintf(fakeRcService, dir)), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "rc-update"), []byte(fmt.Sprintf(fakeRcUpdate, dir)), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "sudo"), []byte(fmt.Sprintf(fakeSudo, dir)), 0o755))
+	t.Setenv("PATH", dir)
+
+	// the commands which controlled services, ignoring status queries
+	return func() []string {
+		content, err := os.ReadFile(filepath.Join(dir, "log"))
+		assert.NoError(t, err)
+		var controlled []string
+		for _, line := range strings.Split(strings.TrimSpace(string(content)), "\n") {
+			if !strings.HasSuffix(line, "status") && !strings.HasPrefix(line, "rc-update show") {
+				controlled = append(controlled, line)
+			}
+		}
+		assert.NoError(t, os.WriteFile(filepath.Join(dir, "log"), nil, 0o644))
+		return controlled
+	}, dir
+}
+
+func TestService(t *testing.T) {
+	invocations, dir := serviceHost(t)
+
+	enabled := true
+	action := &Action{
+		Description: "service",
+		Service: &Service{
+			Name:    "<!! .Context.name !!>",
+			State:   serviceStateStarted,
+			Enabled: &enabled,
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.ExecContext.Set("nginx", "name"))
+
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, "openrc", exInst.ExecContext.GetString(ImmediateKey, "init"))
+	assert.Equal(t, []any{"start", "enable"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+	assert.Empty(t, invocations())
+
+	exInst.config.Check = false
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"rc-service nginx start", "rc-update add nginx default"}, invocations())
+	assert.False(t, changed(t, exInst, action))
+	assert.Empty(t, invocations())
+
+	// a running service is reloaded, and one which isn't is started
+	action.Service.State = serviceStateReloaded
+	action.Service.Enabled = nil
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"rc-service nginx reload"}, invocations())
+
+	action.Service.State = serviceStateStopped
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"rc-service nginx stop"}, invocations())
+	assert.False(t, changed(t, exInst, action))
+
+	action.Service.State = serviceStateRestarted
+	assert.True(t, changed(t, exInst, action))
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"rc-service nginx restart", "rc-service nginx restart"}, invocations())
+
+	enabled = false
+	action.Service.State = ""
+	action.Service.Enabled = &enabled
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"rc-update del nginx default"}, invocations())
+
+	// the name is matched as is rather than as a pattern, and the status is inspected with the privileges of the action
+	action.Service = &Service{Name: "ng.inx", Enabled: &enabled}
+	action.Sudo = true
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "ngxinx.enabled"), nil, 0o644))
+	assert.False(t, changed(t, exInst, action))
+	assert.FileExists(t, filepath.Join(dir, "sudo"))
+	assert.Empty(t, invocations())
+
+	for _, invalid := range []*Service{
+		{State: serviceStateStarted},
+		{Name: "nginx"},
+		{Name: "nginx", State: "running"},
+	} {
+		assert.Error(t, (&Action{Service: invalid}).Validate())
+	}
+}
@@ -0,0 +1,254 @@
+package sequence
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/config"
+	"github.com/frozengoats/crucible/internal/functions"
+	"github.com/frozengoats/crucible/internal/log"
+	"github.com/frozengoats/crucible/internal/render"
+	"github.com/frozengoats/kvstore"
+)
+
+// reservedImmediateKeys are populated on the immediate context by the executor for every action, so a set action would
+// have its value of any of them replaced
+var reservedImmediateKeys = []string{"item", "stdout", "stderr", "exitCode", "json", "yaml", "postProcess", "changed"}
+
+// validateSetKeys rejects set keys which name an action sharing the same context, since the context captured by that
+// action would replace the value, or the value would replace the captured context
+func validateSetKeys(actions []*Action) error {
+	var all []*Action
+	var flatten func(actions []*Action)
+	flatten = func(actions []*Action) {
+		for _, a := range actions {
+			all = append(all, a)
+			// blocks share the context of the sequence containing them, whereas imports have their own
+			flatten(a.nestedActions())
+		}
+	}
+	flatten(actions)
+
+	names := map[string]struct{}{}
+	for _, a := range all {
+		if a.Name != "" {
+			names[a.Name] = struct{}{}
+		}
+	}
+	for _, a := range all {
+		for k := range a.Set {
+			if _, ok := names[k]; ok {
+				return fmt.Errorf("set action \"%s\" cannot set \"%s\", which is the name of an action in the same sequence", a.Description, k)
+			}
+		}
+	}
+
+	return nil
+}
+
+// factsPath is the local file in which the facts of a host are persisted between runs.  facts belong to the user
+// running crucible rather than to a recipe, which may be a cached oci artifact, so they are kept in the configured
+// facts path or otherwise under the home directory.
+func factsPath(config *config.Config, hostIdent string) (string, error) {
+	dir := config.Executor.FactsPath
+	if dir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err != nil {
+			return "", fmt.Errorf("unable to determine where to keep facts: %w", err)
+		}
+		dir = filepath.Join(homeDir, "crucible", "facts")
+	}
+	return filepath.Join(dir, hostIdent+".json"), nil
+}
+
+// Facts returns the persisted facts of the host, which are only read once a sequence refers to them or persists more
+func (ei *ExecutionInstance) Facts() (*kvstore.Store, error) {
+	if ei.facts == nil {
+		facts, err := loadFacts(ei.config, ei.hostIdent)
+		if err != nil {
+			return nil, err
+		}
+		ei.facts = facts
+	}
+
+	return ei.facts, nil
+}
+
+// loadFacts loads the persisted facts of a host, which are empty when none have been persisted yet
+func loadFacts(config *config.Config, hostIdent string) (*kvstore.Store, error) {
+	p, err := factsPath(config, hostIdent)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(p)
+	if os.IsNotExist(err) {
+		return kvstore.NewStore(), nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("unable to read facts of %s: %w", hostIdent, err)
+	}
+
+	var facts map[string]any
+	err = json.Unmarshal(content, &facts)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse facts of %s: %w", hostIdent, err)
+	}
+
+	return kvstore.FromMapping(facts)
+}
+
+// saveFacts writes the facts of a host to a temporary file alongside the facts file before renaming it into place, so
+// that the facts are never left partially written
+func saveFacts(p string, content []byte) error {
+	err := os.MkdirAll(filepath.Dir(p), 0o755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.CreateTemp(filepath.Dir(p), filepath.Base(p)+".*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(f.Name())
+	}()
+
+	_, err = f.Write(content)
+	if err == nil {
+		err = f.Chmod(0o644)
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+
+	return os.Rename(f.Name(), p)
+}
+
+// renderValue renders every string within a value, recursing into arrays and mappings, so that a value which is entirely
+// a single template takes on the type of the evaluated expression
+func (ei *ExecutionInstance) renderValue(value any) (any, error) {
+	switch t := value.(type) {
+	case string:
+		return render.Render(t, ei.variableLookup, functions.Call)
+	case []any:
+		rendered := make([]any, len(t))
+		for i, v := range t {
+			r, err := ei.renderValue(v)
+			if err != nil {
+				return nil, err
+			}
+			rendered[i] = r
+		}
+		return rendered, nil
+	case map[string]any:
+		rendered := make(map[string]any, len(t))
+		for k, v := range t {
+			r, err := ei.renderValue(v)
+			if err != nil {
+				return nil, err
+			}
+			rendered[k] = r
+		}
+		return rendered, nil
+	default:
+		return value, nil
+	}
+}
+
+// setValues stores values, each rendered against the context as it was before the action, on the sequence context and
+// the immediate context.  with persist, the values are also stored in the facts of the host, which are written locally
+// and available as .Facts in this and subsequent runs.  nothing is executed on the host, so values are also set in check
+// mode, though the facts are left untouched.  the action only reports a change when the persisted facts changed.
+func (ei *ExecutionInstance) setValues(action *Action) (*actionResult, error) {
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	keys := make([]string, 0, len(action.Set))
+	for k := range action.Set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	values := make(map[string]any, len(keys))
+	for _, k := range keys {
+		value, err := ei.renderValue(action.Set[k])
+		if err != nil {
+			return nil, fmt.Errorf("unable to render set value %s: %w", k, err)
+		}
+		values[k] = value
+	}
+
+	for _, k := range keys {
+		err := ei.ExecContext.Set(values[k], k)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set %s: %w", k, err)
+		}
+		err = ei.ExecContext.Set(values[k], ImmediateKey, k)
+		if err != nil {
+			return nil, fmt.Errorf("unable to set %s: %w", k, err)
+		}
+	}
+
+	if !action.Persist {
+		log.Info(logCtx, "set %s", strings.Join(keys, ", "))
+		return &actionResult{}, nil
+	}
+
+	existing, err := ei.Facts()
+	if err != nil {
+		return nil, err
+	}
+	previous, err := json.Marshal(existing.GetMapping())
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode facts: %w", err)
+	}
+	facts := existing.DeepCopy()
+	for _, k := range keys {
+		err := facts.Set(values[k], k)
+		if err != nil {
+			return nil, fmt.Errorf("unable to persist %s: %w", k, err)
+		}
+	}
+	current, err := json.Marshal(facts.GetMapping())
+	if err != nil {
+		return nil, fmt.Errorf("unable to encode facts: %w", err)
+	}
+
+	// comparing the encoded facts disregards the difference between integers and the floats they are read back as
+	if bytes.Equal(previous, current) {
+		log.Info(logCtx, "set %s, facts are unchanged", strings.Join(keys, ", "))
+		return &actionResult{}, nil
+	}
+
+	p, err := factsPath(ei.config, ei.hostIdent)
+	if err != nil {
+		return nil, err
+	}
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Dest:    p,
+			Changes: keys,
+		})
+		log.Info(logCtx, "check mode, would persist %s to %s", strings.Join(keys, ", "), p)
+		return &actionResult{changed: true}, nil
+	}
+
+	err = saveFacts(p, current)
+	if err != nil {
+		return nil, fmt.Errorf("unable to write facts of %s: %w", ei.hostIdent, err)
+	}
+	ei.facts = facts
+
+	log.Info(logCtx, "set and persisted %s", strings.Join(keys, ", "))
+	return &actionResult{changed: true}, nil
+}
@@ -0,0 +1,157 @@
+package sequence
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/config"
+	"github.com/frozengoats/kvstore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSet(t *testing.T) {
+	action := &Action{
+		Description: "set",
+		Set: map[string]any{
+			"port":    "<!! 8000 + 80 !!>",
+			"url":     "http://<!! .HostIdent !!>:8080",
+			"enabled": true,
+			"targets": []any{"<!! .HostIdent !!>", "backup"},
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	assert.False(t, changed(t, exInst, action))
+	assert.EqualValues(t, 8080, exInst.ExecContext.Get("port"))
+	assert.Equal(t, "http://testhost:8080", exInst.ExecContext.Get("url"))
+	assert.Equal(t, true, exInst.ExecContext.Get("enabled"))
+	assert.Equal(t, []any{"testhost", "backup"}, exInst.ExecContext.Get("targets"))
+	assert.Equal(t, "http://testhost:8080", exInst.ExecContext.Get(ImmediateKey, "url"))
+
+	// every value is rendered against the context as it was before the action
+	action.Set = map[string]any{
+		"port":     "<!! .Context.port + 1 !!>",
+		"previous": "<!! .Context.port !!>",
+	}
+	assert.False(t, changed(t, exInst, action))
+	assert.EqualValues(t, 8081, exInst.ExecContext.Get("port"))
+	assert.EqualValues(t, 8080, exInst.ExecContext.Get("previous"))
+
+	for _, invalid := range []*Action{
+		{Set: map[string]any{"not valid": 1}},
+		{Set: map[string]any{ImmediateKey: 1}},
+		{Set: map[string]any{"stdout": 1}},
+		{Persist: true, Shell: "true"},
+	} {
+		assert.Error(t, invalid.Validate())
+	}
+
+	// a key naming an action of the same sequence, including within a block, would collide with its captured context
+	seq := &Sequence{
+		Sequence: []*Action{
+			{Description: "set", Set: map[string]any{"release": "1.2.0"}},
+			{Description: "block", Block: []*Action{{Name: "release", Shell: "true"}}},
+		},
+	}
+	assert.EqualError(t, seq.Validate(), "set action \"set\" cannot set \"release\", which is the name of an action in the same sequence")
+	seq.Sequence[1].Block[0].Name = "deploy"
+	assert.NoError(t, seq.Validate())
+}
+
+// hostFacts returns the facts of the host, loading them if they haven't been used yet
+func hostFacts(t *testing.T, exInst *ExecutionInstance) *kvstore.Store {
+	facts, err := exInst.Facts()
+	assert.NoError(t, err)
+	return facts
+}
+
+func TestSetPersist(t *testing.T) {
+	action := &Action{
+		Description: "persist",
+		Set: map[string]any{
+			"release": "<!! .Context.version !!>",
+		},
+		Persist: true,
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.ExecContext.Set("1.2.0", "version"))
+	p := filepath.Join(exInst.config.Executor.FactsPath, "testhost.json")
+
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, "1.2.0", exInst.ExecContext.Get("release"))
+	assert.Nil(t, hostFacts(t, exInst).Get("release"))
+	assert.NoFileExists(t, p)
+
+	exInst.config.Check = false
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, "1.2.0", hostFacts(t, exInst).Get("release"))
+	content, err := os.ReadFile(p)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"release": "1.2.0"}`, string(content))
+	assert.False(t, changed(t, exInst, action))
+
+	// facts are kept apart from the recipe, which may be a cached artifact
+	assert.NoDirExists(t, filepath.Join(exInst.config.CwdPath, ".crucible"))
+}
+
+func TestFactsSurviveNewExecutionInstance(t *testing.T) {
+	persist := &Action{
+		Description: "persist",
+		Set: map[string]any{
+			"release":  "1.2.0",
+			"replicas": 3,
+		},
+		Persist: true,
+	}
+	exInst := syncInstance(t, persist)
+	assert.True(t, changed(t, exInst, persist))
+
+	// a later run against the same host loads the facts, available as .Facts, so persisting them again changes nothing
+	read := &Action{
+		Description: "read",
+		Set: map[string]any{
+			"deployed": "<!! .Facts.release !!>",
+		},
+	}
+	for _, action := range []*Action{read, persist} {
+		seq := &Sequence{Sequence: []*Action{action}}
+		next, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), exInst.config, "testhost")
+		assert.NoError(t, err)
+		_, err = next.Next()
+		assert.NoError(t, err)
+
+		assert.EqualValues(t, 3, hostFacts(t, next).Get("replicas"))
+		assert.False(t, changed(t, next, action))
+	}
+
+	// facts are kept per host
+	exInst.config.Hosts["otherhost"] = &config.HostConfig{}
+	seq := &Sequence{Sequence: []*Action{read}}
+	other, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), exInst.config, "otherhost")
+	assert.NoError(t, err)
+	assert.Nil(t, hostFacts(t, other).Get("release"))
+
+	// facts are only read once used, so facts which can't be read only fail the sequences using them
+	assert.NoError(t, os.WriteFile(filepath.Join(exInst.config.Executor.FactsPath, "otherhost.json"), []byte("{"), 0o644))
+	shell := &Action{Description: "shell", Shell: "true"}
+	seq = &Sequence{Sequence: []*Action{shell, read}}
+	other, err = seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), exInst.config, "otherhost")
+	assert.NoError(t, err)
+	_, err = other.Next()
+	assert.NoError(t, err)
+	assert.NoError(t, other.Execute(context.Background(), shell))
+	_, err = other.Next()
+	assert.NoError(t, err)
+	assert.Error(t, other.Execute(context.Background(), read))
+
+	// nothing but the facts themselves is left behind by writing them
+	entries, err := os.ReadDir(exInst.config.Executor.FactsPath)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 2)
+}
@@ -0,0 +1,546 @@
+package sequence
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/functions"
+	"github.com/frozengoats/crucible/internal/log"
+	"github.com/frozengoats/crucible/internal/render"
+)
+
+const dirChecksum = "dir"
+
+// syncEntry is a local file, directory or link which is a candidate for transfer to the remote host
+type syncEntry struct {
+	localPath string      // path on the local system
+	name      string      // slash separated path, relative to the remote sync root
+	info      fs.FileInfo // local file info
+	link      string      // link target, if the entry is a symbolic link
+	checksum  string      // sha256 sum of a file, the prefixed target of a link, or dirChecksum for directories
+	mode      string      // octal permission bits
+	owner     string      // owning user name, or uid if the user is unknown
+	group     string      // owning group name, or gid if the group is unknown
+}
+
+// remoteEntry is the state of a path beneath the remote sync root
+type remoteEntry struct {
+	checksum string
+	mode     string
+	owner    string
+	group    string
+}
+
+// sync transfers any local files which differ from their remote counterparts, identified by comparing sha256 sums.
+// in keeping with rsync, a src directory ending in a slash has its contents synced into dest, otherwise the directory
+// itself is synced into dest.  the paths transferred and deleted are stored on the immediate context as .files and
+// .deleted respectively.
+func (ei *ExecutionInstance) sync(ctx context.Context, action *Action) (*actionResult, error) {
+	syncAction := action.Sync
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	srcAny, err := render.Render(syncAction.Src, ei.variableLookup, functions.Call)
+	if err != nil {
+		return nil, fmt.Errorf("unable to evaluate sync src: %w", err)
+	}
+	src := render.ToString(srcAny)
+
+	destAny, err := render.Render(syncAction.Dest, ei.variableLookup, functions.Call)
+	if err != nil {
+		return nil, fmt.Errorf("unable to evaluate sync dest: %w", err)
+	}
+	dest := render.ToString(destAny)
+
+	if src == "" || dest == "" {
+		return nil, fmt.Errorf("sync requires both a src and a dest")
+	}
+
+	if !filepath.IsAbs(src) {
+		p, err := filepath.Abs(filepath.Join(ei.config.CwdPath, src))
+		if err != nil {
+			return nil, fmt.Errorf("unable to transform sync path %s to abs path: %w", src, err)
+		}
+
+		// the trailing slash is meaningful, and would otherwise be lost when cleaning the path
+		if strings.HasSuffix(src, "/") {
+			p += "/"
+		}
+		src = p
+	}
+
+	info, err := os.Stat(src)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sync %s: %w", src, err)
+	}
+
+	// the remote root is the directory into which entries are extracted, while the prefix is the name of the src
+	// beneath it, which is empty when syncing the contents of a directory
+	var root, prefix string
+	if info.IsDir() {
+		root = dest
+		if !strings.HasSuffix(src, "/") {
+			prefix = filepath.Base(src)
+		}
+	} else {
+		isDir := strings.HasSuffix(dest, "/")
+		if !isDir {
+			isDir, err = ei.isRemoteDir(ctx, action, dest)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		if isDir {
+			root = dest
+			prefix = filepath.Base(src)
+		} else {
+			root = path.Dir(dest)
+			prefix = path.Base(dest)
+		}
+	}
+
+	entries, err := localSyncEntries(src, prefix, syncAction.Exclude)
+	if err != nil {
+		return nil, err
+	}
+
+	remote, err := ei.remoteSyncManifest(ctx, action, root, prefix)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		transfers  []*syncEntry
+		files      []string
+		attributes []string
+	)
+	local := map[string]bool{}
+	for _, entry := range entries {
+		local[entry.name] = true
+
+		r := remote[entry.name]
+		transfer := r == nil || r.checksum != entry.checksum
+		if transfer {
+			transfers = append(transfers, entry)
+			if !entry.info.IsDir() {
+				files = append(files, entry.name)
+			}
+		}
+
+		if attr := syncAttributes(syncAction, entry, r, transfer); attr != "" {
+			attributes = append(attributes, attr)
+		}
+	}
+
+	var deleted []string
+	if syncAction.Delete && info.IsDir() {
+		deleted = syncDeletions(remote, local, prefix, syncAction.Exclude)
+	}
+
+	err = ei.ExecContext.Set(files, ImmediateKey, "files")
+	if err != nil {
+		return nil, err
+	}
+	err = ei.ExecContext.Set(deleted, ImmediateKey, "deleted")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(transfers) == 0 && len(attributes) == 0 && len(deleted) == 0 {
+		log.Info(logCtx, "sync of %s to %s is unchanged, skipping transfer", src, dest)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Src:     src,
+			Dest:    dest,
+			Files:   files,
+			Deleted: deleted,
+		})
+		log.Info(logCtx, "check mode, would sync %s to %s%s", src, dest, syncReport(files, deleted, len(attributes)))
+		return &actionResult{changed: true}, nil
+	}
+
+	if len(transfers) > 0 {
+		reader, writer := io.Pipe()
+		go func() {
+			_ = writer.CloseWithError(writeSyncArchive(writer, transfers))
+		}()
+
+		result, err := ei.runSyncScript(ctx, action, syncExtractScript, root, reader)
+		_ = reader.Close()
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	if len(attributes) > 0 {
+		result, err := ei.runSyncScript(ctx, action, syncAttributesScript, root, strings.NewReader(strings.Join(attributes, "\n")+"\n"))
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	if len(deleted) > 0 {
+		result, err := ei.runSyncScript(ctx, action, syncDeleteScript, root, strings.NewReader(strings.Join(deleted, "\n")+"\n"))
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	log.Info(logCtx, "synced %s to %s%s", src, dest, syncReport(files, deleted, len(attributes)))
+	return &actionResult{changed: true}, nil
+}
+
+// runSyncScript runs one of the sync scripts against the remote sync root, with the privileges of the action
+func (ei *ExecutionInstance) runSyncScript(ctx context.Context, action *Action, script string, root string, stdin io.Reader) (*actionResult, error) {
+	cmd, err := ei.privileged(action, []string{ei.config.Executor.ShellBinary, "-c", script, root})
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ei.executeRemoteCommand(ctx, ei.executionClient, stdin, cmd)
+	if err != nil {
+		return nil, fmt.Errorf("unable to sync to %s: %w", root, err)
+	}
+
+	return result, nil
+}
+
+// isRemoteDir indicates whether the remote path is an existing directory
+func (ei *ExecutionInstance) isRemoteDir(ctx context.Context, action *Action, remotePath string) (bool, error) {
+	result, err := ei.runSyncScript(ctx, action, isDirScript, remotePath, nil)
+	if err != nil {
+		return false, err
+	}
+
+	return result.exitCode == 0, nil
+}
+
+// remoteSyncManifest obtains the state of everything beneath the prefix within the remote root, or of everything
+// beneath the root when there is no prefix, keyed by the path relative to the root
+func (ei *ExecutionInstance) remoteSyncManifest(ctx context.Context, action *Action, root string, prefix string) (map[string]*remoteEntry, error) {
+	cmd := []string{ei.config.Executor.ShellBinary, "-c", syncManifestScript, root}
+	if prefix != "" {
+		cmd = append(cmd, prefix)
+	}
+	cmd, err := ei.privileged(action, cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := ei.executeRemoteCommand(ctx, ei.executionClient, nil, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if result.exitCode != 0 {
+		return nil, fmt.Errorf("unable to list remote files at %s: %w", root, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+
+	manifest := map[string]*remoteEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(result.stdout))
+	for scanner.Scan() {
+		value, name, found := strings.Cut(scanner.Text(), "  ")
+		if !found {
+			continue
+		}
+
+		name = strings.TrimPrefix(name, "./")
+		entry, ok := manifest[name]
+		if !ok {
+			entry = &remoteEntry{}
+			manifest[name] = entry
+		}
+
+		if attr, ok := strings.CutPrefix(value, "attr:"); ok {
+			parts := strings.SplitN(attr, ":", 3)
+			if len(parts) == 3 {
+				entry.mode, entry.owner, entry.group = parts[0], parts[1], parts[2]
+			}
+			continue
+		}
+
+		// sha256sum marks names containing special characters with a leading backslash
+		entry.checksum = strings.TrimPrefix(value, "\\")
+	}
+
+	return manifest, scanner.Err()
+}
+
+// localSyncEntries walks the local src, producing entries named relative to the remote root, under the given prefix
+func localSyncEntries(src string, prefix string, exclude []string) ([]*syncEntry, error) {
+	var entries []*syncEntry
+	err := filepath.WalkDir(src, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, p)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if excluded(exclude, rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		name := path.Join(prefix, rel)
+		if name == "." || name == "" {
+			// the root of a directory whose contents are synced is the remote root itself
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		entry := &syncEntry{
+			localPath: p,
+			name:      name,
+			info:      info,
+			mode:      strconv.FormatUint(uint64(unixMode(info.Mode())), 8),
+		}
+
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		entry.owner = hdr.Uname
+		if entry.owner == "" {
+			entry.owner = strconv.Itoa(hdr.Uid)
+		}
+		entry.group = hdr.Gname
+		if entry.group == "" {
+			entry.group = strconv.Itoa(hdr.Gid)
+		}
+
+		switch {
+		case info.Mode()&fs.ModeSymlink != 0:
+			entry.link, err = os.Readlink(p)
+			if err != nil {
+				return err
+			}
+			entry.checksum = "link:" + entry.link
+		case info.IsDir():
+			entry.checksum = dirChecksum
+		case info.Mode().IsRegular():
+			entry.checksum, err = fileChecksum(p)
+			if err != nil {
+				return err
+			}
+		default:
+			log.Debug(nil, "skipping sync of irregular file %s", p)
+			return nil
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("unable to read sync src %s: %w", src, err)
+	}
+
+	return entries, nil
+}
+
+// excluded indicates whether a path relative to the sync src, or any of its parent directories, matches one of the
+// exclude patterns.  patterns containing a slash are matched against the whole relative path, otherwise only against
+// the base name.
+func excluded(patterns []string, rel string) bool {
+	for p := rel; p != "." && p != "/" && p != ""; p = path.Dir(p) {
+		for _, pattern := range patterns {
+			pattern = strings.Trim(pattern, "/")
+			target := path.Base(p)
+			if strings.Contains(pattern, "/") {
+				target = p
+			}
+
+			if ok, _ := path.Match(pattern, target); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// syncAttributes produces the mode|owner|path line required to bring the remote attributes of an entry in line with
+// the local ones, according to what is to be preserved, or an empty string when nothing needs to change
+func syncAttributes(syncAction *Sync, entry *syncEntry, remote *remoteEntry, transferred bool) string {
+	if remote == nil {
+		remote = &remoteEntry{}
+	}
+
+	mode := "-"
+	// link permissions are meaningless, and changing them would change the link target instead
+	if syncAction.PreservePerms && entry.link == "" && (transferred || remote.mode != entry.mode) {
+		mode = entry.mode
+	}
+
+	// extraction never restores ownership, so anything transferred needs it applied
+	owner := "-"
+	ownerChanged := syncAction.PreserveOwner && (transferred || remote.owner != entry.owner)
+	groupChanged := syncAction.PreserveGroup && (transferred || remote.group != entry.group)
+	if ownerChanged || groupChanged {
+		owner = ""
+		if syncAction.PreserveOwner {
+			owner = entry.owner
+		}
+		if syncAction.PreserveGroup {
+			owner += ":" + entry.group
+		}
+	}
+
+	if mode == "-" && owner == "-" {
+		return ""
+	}
+
+	return fmt.Sprintf("%s|%s|%s", mode, owner, entry.name)
+}
+
+// syncDeletions determines the remote paths which do not exist locally and are not excluded, listing only the
+// top-most path of any removed directory
+func syncDeletions(remote map[string]*remoteEntry, local map[string]bool, prefix string, exclude []string) []string {
+	var names []string
+	for name := range remote {
+		if name == "." || name == prefix || local[name] {
+			continue
+		}
+
+		rel := name
+		if prefix != "" {
+			rel = strings.TrimPrefix(name, prefix+"/")
+		}
+		if excluded(exclude, rel) {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var deleted []string
+	removed := map[string]bool{}
+	for _, name := range names {
+		parentRemoved := false
+		for p := path.Dir(name); p != "." && p != "/"; p = path.Dir(p) {
+			if removed[p] {
+				parentRemoved = true
+				break
+			}
+		}
+
+		removed[name] = true
+		if !parentRemoved {
+			deleted = append(deleted, name)
+		}
+	}
+
+	return deleted
+}
+
+// syncReport describes the changes made by a sync, for logging
+func syncReport(files []string, deleted []string, attributes int) string {
+	var report strings.Builder
+	for _, f := range files {
+		report.WriteString("\n  transferred " + f)
+	}
+	for _, f := range deleted {
+		report.WriteString("\n  deleted " + f)
+	}
+	if attributes > 0 {
+		report.WriteString(fmt.Sprintf("\n  updated attributes of %d paths", attributes))
+	}
+
+	return report.String()
+}
+
+// unixMode converts the file mode to the unix permission bits, including the setuid, setgid and sticky bits
+func unixMode(mode fs.FileMode) uint32 {
+	bits := uint32(mode.Perm())
+	if mode&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if mode&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if mode&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+
+	return bits
+}
+
+// fileChecksum computes the hex encoded sha256 sum of a local file
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	if _, err = io.Copy(h, f); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeSyncArchive writes the entries to a tar stream
+func writeSyncArchive(w io.Writer, entries []*syncEntry) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		hdr, err := tar.FileInfoHeader(entry.info, entry.link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = entry.name
+		if entry.info.IsDir() {
+			hdr.Name += "/"
+		}
+
+		if err = tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !entry.info.Mode().IsRegular() {
+			continue
+		}
+
+		f, err := os.Open(entry.localPath)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(tw, f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return tw.Close()
+}
@@ -0,0 +1,196 @@
+package sequence
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func syncInstance(t *testing.T, action *Action) *ExecutionInstance {
+	cfg := &config.Config{
+		Hosts: map[string]*config.HostConfig{
+			"testhost": {},
+		},
+	}
+	cfg.Executor.ShellBinary = "sh"
+	cfg.Executor.FactsPath = t.TempDir()
+
+	seq := &Sequence{Sequence: []*Action{action}}
+	exInst, err := seq.NewExecutionInstance(cmdsession.NewLocalExecutionClient(), cfg, "testhost")
+	assert.NoError(t, err)
+	_, err = exInst.Next()
+	assert.NoError(t, err)
+	return exInst
+}
+
+func changed(t *testing.T, exInst *ExecutionInstance, action *Action) bool {
+	assert.NoError(t, exInst.ExecContext.Set(map[string]any{}, ImmediateKey))
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+	return exInst.ExecContext.GetBool(ImmediateKey, "changed")
+}
+
+func TestSyncDirectory(t *testing.T) {
+	src := filepath.Join(t.TempDir(), "bundle")
+	dest := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "inner", "empty"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "bundle.txt"), []byte("bundle\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "inner", "inner.txt"), []byte("inner\n"), 0o644))
+	assert.NoError(t, os.Symlink("bundle.txt", filepath.Join(src, "link.txt")))
+
+	action := &Action{
+		Description: "sync",
+		Sync: &Sync{
+			Src:  src,
+			Dest: dest,
+		},
+	}
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	content, err := os.ReadFile(filepath.Join(dest, "bundle", "inner", "inner.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "inner\n", string(content))
+	assert.DirExists(t, filepath.Join(dest, "bundle", "inner", "empty"))
+	target, err := os.Readlink(filepath.Join(dest, "bundle", "link.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "bundle.txt", target)
+
+	// nothing differs, so nothing is transferred
+	assert.False(t, changed(t, exInst, action))
+
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "bundle.txt"), []byte("updated\n"), 0o644))
+	assert.True(t, changed(t, exInst, action))
+	content, err = os.ReadFile(filepath.Join(dest, "bundle", "bundle.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "updated\n", string(content))
+
+	// a trailing slash syncs the contents of the directory rather than the directory itself
+	contentsDest := t.TempDir()
+	action.Sync = &Sync{
+		Src:  src + "/",
+		Dest: contentsDest,
+	}
+	assert.True(t, changed(t, exInst, action))
+	assert.FileExists(t, filepath.Join(contentsDest, "inner", "inner.txt"))
+	assert.NoDirExists(t, filepath.Join(contentsDest, "bundle"))
+}
+
+func TestSyncFile(t *testing.T) {
+	srcDir := t.TempDir()
+	dest := t.TempDir()
+	src := filepath.Join(srcDir, "file.txt")
+	assert.NoError(t, os.WriteFile(src, []byte("file\n"), 0o644))
+
+	// an existing directory receives the file under its own name
+	action := &Action{
+		Description: "sync",
+		Sync: &Sync{
+			Src:  src,
+			Dest: dest,
+		},
+	}
+	exInst := syncInstance(t, action)
+	assert.True(t, changed(t, exInst, action))
+	assert.FileExists(t, filepath.Join(dest, "file.txt"))
+	assert.False(t, changed(t, exInst, action))
+
+	// otherwise the dest names the file
+	action.Sync.Dest = filepath.Join(dest, "renamed.txt")
+	assert.True(t, changed(t, exInst, action))
+	content, err := os.ReadFile(filepath.Join(dest, "renamed.txt"))
+	assert.NoError(t, err)
+	assert.Equal(t, "file\n", string(content))
+}
+
+func TestSyncCheckModeDoesNotTransfer(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "file.txt"), []byte("file\n"), 0o644))
+
+	action := &Action{
+		Description: "sync",
+		Sync: &Sync{
+			Src:  src + "/",
+			Dest: dest,
+		},
+	}
+	exInst := syncInstance(t, action)
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	assert.NoFileExists(t, filepath.Join(dest, "file.txt"))
+	assert.Len(t, exInst.Plan, 1)
+}
+
+func TestSyncExcludeAndDelete(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(src, "cache"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "keep.txt"), []byte("keep\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "debug.log"), []byte("log\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "cache", "data"), []byte("data\n"), 0o644))
+	assert.NoError(t, os.MkdirAll(filepath.Join(dest, "stale", "nested"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dest, "stale", "nested", "old.txt"), []byte("old\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dest, "remote.log"), []byte("remote\n"), 0o644))
+
+	action := &Action{
+		Description: "sync",
+		Sync: &Sync{
+			Src:     src + "/",
+			Dest:    "<!! .Context.dest !!>",
+			Exclude: []string{"*.log", "/cache"},
+			Delete:  true,
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.ExecContext.Set(dest, "dest"))
+
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"keep.txt"}, exInst.ExecContext.Get(ImmediateKey, "files"))
+	assert.Equal(t, []any{"stale"}, exInst.ExecContext.Get(ImmediateKey, "deleted"))
+	assert.FileExists(t, filepath.Join(dest, "keep.txt"))
+	assert.NoFileExists(t, filepath.Join(dest, "debug.log"))
+	assert.NoDirExists(t, filepath.Join(dest, "cache"))
+	assert.NoDirExists(t, filepath.Join(dest, "stale"))
+	// excluded paths are protected from deletion
+	assert.FileExists(t, filepath.Join(dest, "remote.log"))
+
+	assert.False(t, changed(t, exInst, action))
+
+	action.Sync.Exclude = []string{"[invalid"}
+	assert.Error(t, action.Validate())
+}
+
+func TestSyncPreservePerms(t *testing.T) {
+	src := t.TempDir()
+	dest := t.TempDir()
+	assert.NoError(t, os.WriteFile(filepath.Join(src, "run.sh"), []byte("#!/bin/sh\n"), 0o755))
+	assert.NoError(t, os.Chmod(filepath.Join(src, "run.sh"), 0o755))
+	assert.NoError(t, os.WriteFile(filepath.Join(dest, "run.sh"), []byte("#!/bin/sh\n"), 0o600))
+
+	action := &Action{
+		Description: "sync",
+		Sync: &Sync{
+			Src:  src + "/",
+			Dest: dest,
+		},
+	}
+	exInst := syncInstance(t, action)
+
+	// identical content with differing permissions is left alone unless permissions are preserved
+	assert.False(t, changed(t, exInst, action))
+
+	action.Sync.PreservePerms = true
+	assert.True(t, changed(t, exInst, action))
+	assert.Empty(t, exInst.ExecContext.Get(ImmediateKey, "files"))
+	info, err := os.Stat(filepath.Join(dest, "run.sh"))
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o755), info.Mode().Perm())
+
+	assert.False(t, changed(t, exInst, action))
+}
@@ -0,0 +1,568 @@
+package sequence
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/frozengoats/crucible/internal/log"
+)
+
+const (
+	accountStatePresent = "present"
+	accountStateAbsent  = "absent"
+
+	// the exit code of getent when an account does not exist
+	missingAccountExitCode = 2
+
+	// the accounts of a host are managed with the shadow utilities (useradd etc.) where they are available, falling back
+	// to the busybox applets (adduser etc.) found on alpine, which can't modify an existing account
+	accountToolsShadow  = "shadow"
+	accountToolsBusybox = "busybox"
+)
+
+// userStatusScript prints the account tools available, followed by the passwd entry of the user named by $0, the name
+// of its primary group, and the names and gids of every group it belongs to
+const userStatusScript = `if command -v useradd >/dev/null 2>&1; then echo shadow; else echo busybox; fi
+p=$(getent passwd "$0") || exit 2
+echo "$p"
+getent group "$(echo "$p" | cut -d: -f4)" | cut -d: -f1
+id -Gn "$0"
+id -G "$0"`
+
+// groupStatusScript prints the account tools available, followed by the group entry of the group named by $0
+const groupStatusScript = `if command -v groupadd >/dev/null 2>&1; then echo shadow; else echo busybox; fi
+getent group "$0" || exit 2`
+
+// remoteUser is the state of a user account as reported by userStatusScript
+type remoteUser struct {
+	uid       int
+	gid       string
+	groupName string
+	home      string
+	shell     string
+	groups    []string
+	groupIds  []string
+}
+
+// hasGroup indicates whether the primary group of the user, given as a name or gid, is the one specified
+func (u *remoteUser) hasGroup(group string) bool {
+	return group == u.groupName || group == u.gid
+}
+
+// memberOf indicates whether the user belongs to the group, given as a name or gid
+func (u *remoteUser) memberOf(group string) bool {
+	return slices.Contains(u.groups, group) || slices.Contains(u.groupIds, group)
+}
+
+func validateAccount(name string, state string) error {
+	if name == "" {
+		return fmt.Errorf("a name is required")
+	}
+
+	switch state {
+	case "", accountStatePresent, accountStateAbsent:
+	default:
+		return fmt.Errorf("state must be one of %s or %s", accountStatePresent, accountStateAbsent)
+	}
+
+	return nil
+}
+
+func (u *User) validate() error {
+	err := validateAccount(u.Name, u.State)
+	if err != nil {
+		return err
+	}
+
+	if u.State == accountStateAbsent && (u.Uid != nil || u.Group != "" || len(u.Groups) > 0 || u.Shell != "" || u.Home != "" || len(u.AuthorizedKeys) > 0) {
+		return fmt.Errorf("only a name can be specified for an absent user")
+	}
+
+	return nil
+}
+
+func (g *Group) validate() error {
+	err := validateAccount(g.Name, g.State)
+	if err != nil {
+		return err
+	}
+
+	if g.State == accountStateAbsent && g.Gid != nil {
+		return fmt.Errorf("only a name can be specified for an absent group")
+	}
+
+	return nil
+}
+
+// user creates, modifies or removes a user account, having first inspected it so that only what differs is changed.
+// supplementary groups are added to those the user already belongs to, and authorized keys are added to those already
+// present.  the changes made are stored on the immediate context as .changes.
+func (ei *ExecutionInstance) user(ctx context.Context, action *Action) (*actionResult, error) {
+	userAction := action.User
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	name, err := ei.renderString("user name", userAction.Name)
+	if err != nil {
+		return nil, err
+	}
+	group, err := ei.renderString("user group", userAction.Group)
+	if err != nil {
+		return nil, err
+	}
+	shell, err := ei.renderString("user shell", userAction.Shell)
+	if err != nil {
+		return nil, err
+	}
+	home, err := ei.renderString("user home", userAction.Home)
+	if err != nil {
+		return nil, err
+	}
+	groups, err := ei.renderStrings("user groups", userAction.Groups)
+	if err != nil {
+		return nil, err
+	}
+	keys, err := ei.renderStrings("user authorizedKeys", userAction.AuthorizedKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	tools, current, err := ei.userStatus(ctx, action, name)
+	if err != nil {
+		return nil, err
+	}
+	if tools == accountToolsBusybox && userAction.State != accountStateAbsent {
+		group, err = ei.groupName(ctx, action, group)
+		if err != nil {
+			return nil, err
+		}
+		for i, g := range groups {
+			groups[i], err = ei.groupName(ctx, action, g)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	var changes []string
+	var commands [][]string
+	switch {
+	case userAction.State == accountStateAbsent:
+		if current != nil {
+			changes = append(changes, "remove user")
+			if tools == accountToolsShadow {
+				commands = append(commands, []string{"userdel", name})
+			} else {
+				commands = append(commands, []string{"deluser", name})
+			}
+		}
+	case current == nil:
+		changes = append(changes, "create user")
+		commands = append(commands, createUserCommand(tools, userAction, name, group, groups, shell, home))
+		if tools == accountToolsBusybox {
+			for _, g := range groups {
+				commands = append(commands, []string{"addgroup", name, g})
+			}
+		}
+	default:
+		var args []string
+		if userAction.Uid != nil && *userAction.Uid != current.uid {
+			changes = append(changes, fmt.Sprintf("uid %d -> %d", current.uid, *userAction.Uid))
+			args = append(args, "-u", strconv.Itoa(*userAction.Uid))
+		}
+		if group != "" && !current.hasGroup(group) {
+			changes = append(changes, fmt.Sprintf("group %s -> %s", current.groupName, group))
+			args = append(args, "-g", group)
+		}
+		if shell != "" && shell != current.shell {
+			changes = append(changes, fmt.Sprintf("shell %s -> %s", current.shell, shell))
+			args = append(args, "-s", shell)
+		}
+		if home != "" && home != current.home {
+			changes = append(changes, fmt.Sprintf("home %s -> %s", current.home, home))
+			args = append(args, "-d", home, "-m")
+		}
+		if len(args) > 0 && tools == accountToolsBusybox {
+			return nil, fmt.Errorf("unable to modify user %s, changing the %s of an existing user requires usermod", name, strings.Join(changes, ", "))
+		}
+
+		var missing []string
+		for _, g := range groups {
+			if !current.memberOf(g) {
+				missing = append(missing, g)
+			}
+		}
+		if len(missing) > 0 {
+			changes = append(changes, fmt.Sprintf("add to groups %s", strings.Join(missing, ", ")))
+			if tools == accountToolsShadow {
+				args = append(args, "-a", "-G", strings.Join(missing, ","))
+			} else {
+				for _, g := range missing {
+					commands = append(commands, []string{"addgroup", name, g})
+				}
+			}
+		}
+
+		if len(args) > 0 {
+			commands = append(commands, append(append([]string{"usermod"}, args...), name))
+		}
+	}
+
+	// the home directory of a user which doesn't exist yet is only known once it has been created, so in check mode
+	// every key is considered missing
+	var missingKeys []string
+	if len(keys) > 0 {
+		missingKeys = keys
+		if current != nil {
+			missingKeys, _, err = ei.missingAuthorizedKeys(ctx, action, current, keys)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if len(missingKeys) > 0 {
+			changes = append(changes, fmt.Sprintf("add %d authorized key(s)", len(missingKeys)))
+		}
+	}
+
+	err = ei.ExecContext.Set(changes, ImmediateKey, "changes")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) == 0 {
+		log.Info(logCtx, "user %s is unchanged", name)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Changes: changes,
+		})
+		log.Info(logCtx, "check mode, would change user %s: %s", name, strings.Join(changes, ", "))
+		return &actionResult{changed: true}, nil
+	}
+
+	result, err := ei.runAccountCommands(ctx, action, commands)
+	if err != nil || result.exitCode != 0 {
+		return result, err
+	}
+
+	if len(missingKeys) > 0 {
+		// the home directory and ownership may have just changed
+		_, current, err = ei.userStatus(ctx, action, name)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			return nil, fmt.Errorf("user %s does not exist after being created", name)
+		}
+
+		result, err = ei.authorizeKeys(ctx, action, current, keys)
+		if err != nil || result.exitCode != 0 {
+			return result, err
+		}
+	}
+
+	log.Info(logCtx, "changed user %s: %s", name, strings.Join(changes, ", "))
+	result.changed = true
+	return result, nil
+}
+
+// createUserCommand produces the command which creates a user with the attributes specified
+func createUserCommand(tools string, userAction *User, name string, group string, groups []string, shell string, home string) []string {
+	if tools == accountToolsBusybox {
+		cmd := []string{"adduser", "-D"}
+		if userAction.Uid != nil {
+			cmd = append(cmd, "-u", strconv.Itoa(*userAction.Uid))
+		}
+		if group != "" {
+			cmd = append(cmd, "-G", group)
+		}
+		if shell != "" {
+			cmd = append(cmd, "-s", shell)
+		}
+		if home != "" {
+			cmd = append(cmd, "-h", home)
+		}
+		if userAction.System {
+			cmd = append(cmd, "-S")
+			if home == "" {
+				cmd = append(cmd, "-H")
+			}
+		}
+		return append(cmd, name)
+	}
+
+	cmd := []string{"useradd"}
+	if userAction.Uid != nil {
+		cmd = append(cmd, "-u", strconv.Itoa(*userAction.Uid))
+	}
+	if group != "" {
+		cmd = append(cmd, "-g", group)
+	}
+	if len(groups) > 0 {
+		cmd = append(cmd, "-G", strings.Join(groups, ","))
+	}
+	if shell != "" {
+		cmd = append(cmd, "-s", shell)
+	}
+	if home != "" {
+		cmd = append(cmd, "-d", home)
+	}
+	if userAction.System {
+		cmd = append(cmd, "-r")
+	}
+	if !userAction.System || home != "" {
+		cmd = append(cmd, "-m")
+	}
+	return append(cmd, name)
+}
+
+// group creates, modifies or removes a group, having first inspected it so that only what differs is changed.  the
+// changes made are stored on the immediate context as .changes.
+func (ei *ExecutionInstance) group(ctx context.Context, action *Action) (*actionResult, error) {
+	groupAction := action.Group
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	name, err := ei.renderString("group name", groupAction.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	tools, gid, exists, err := ei.groupStatus(ctx, action, name)
+	if err != nil {
+		return nil, err
+	}
+
+	var changes []string
+	var commands [][]string
+	switch {
+	case groupAction.State == accountStateAbsent:
+		if exists {
+			changes = append(changes, "remove group")
+			if tools == accountToolsShadow {
+				commands = append(commands, []string{"groupdel", name})
+			} else {
+				commands = append(commands, []string{"delgroup", name})
+			}
+		}
+	case !exists:
+		changes = append(changes, "create group")
+		cmd := []string{"groupadd"}
+		system := "-r"
+		if tools == accountToolsBusybox {
+			cmd = []string{"addgroup"}
+			system = "-S"
+		}
+		if groupAction.Gid != nil {
+			cmd = append(cmd, "-g", strconv.Itoa(*groupAction.Gid))
+		}
+		if groupAction.System {
+			cmd = append(cmd, system)
+		}
+		commands = append(commands, append(cmd, name))
+	case groupAction.Gid != nil && *groupAction.Gid != gid:
+		changes = append(changes, fmt.Sprintf("gid %d -> %d", gid, *groupAction.Gid))
+		if tools == accountToolsBusybox {
+			return nil, fmt.Errorf("unable to modify group %s, changing the gid of an existing group requires groupmod", name)
+		}
+		commands = append(commands, []string{"groupmod", "-g", strconv.Itoa(*groupAction.Gid), name})
+	}
+
+	err = ei.ExecContext.Set(changes, ImmediateKey, "changes")
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changes) == 0 {
+		log.Info(logCtx, "group %s is unchanged", name)
+		return &actionResult{}, nil
+	}
+
+	if ei.config.Check {
+		ei.addPlan(action, &PlannedAction{
+			Changes: changes,
+		})
+		log.Info(logCtx, "check mode, would change group %s: %s", name, strings.Join(changes, ", "))
+		return &actionResult{changed: true}, nil
+	}
+
+	result, err := ei.runAccountCommands(ctx, action, commands)
+	if err != nil || result.exitCode != 0 {
+		return result, err
+	}
+
+	log.Info(logCtx, "changed group %s: %s", name, strings.Join(changes, ", "))
+	result.changed = true
+	return result, nil
+}
+
+// runAccountCommands runs each of the commands with the privileges of the action, stopping at the first to fail
+func (ei *ExecutionInstance) runAccountCommands(ctx context.Context, action *Action, commands [][]string) (*actionResult, error) {
+	result := &actionResult{}
+	for _, command := range commands {
+		cmd, err := ei.privileged(action, command)
+		if err != nil {
+			return nil, err
+		}
+
+		result, err = ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, cmd)
+		if err != nil {
+			return nil, fmt.Errorf("unable to execute %s: %w", command[0], err)
+		}
+		if result.exitCode != 0 {
+			return result, nil
+		}
+	}
+
+	return result, nil
+}
+
+// userStatus determines the account tools available and the state of the user, which is nil if it does not exist
+func (ei *ExecutionInstance) userStatus(ctx context.Context, action *Action, name string) (string, *remoteUser, error) {
+	result, err := ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, []string{ei.config.Executor.ShellBinary, "-c", userStatusScript, name})
+	if err != nil {
+		return "", nil, fmt.Errorf("unable to inspect user %s: %w", name, err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(result.stdout), "\n"), "\n")
+	if result.exitCode == missingAccountExitCode {
+		return lines[0], nil, nil
+	}
+	if result.exitCode != 0 {
+		return "", nil, fmt.Errorf("unable to inspect user %s: %w", name, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+	if len(lines) < 3 {
+		return "", nil, fmt.Errorf("unexpected user description: %s", result.stdout)
+	}
+
+	// name:password:uid:gid:gecos:home:shell
+	parts := strings.Split(lines[1], ":")
+	if len(parts) != 7 {
+		return "", nil, fmt.Errorf("unexpected passwd entry: %s", lines[1])
+	}
+	uid, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", nil, fmt.Errorf("unexpected uid in passwd entry: %s", lines[1])
+	}
+
+	current := &remoteUser{
+		uid:       uid,
+		gid:       parts[3],
+		groupName: lines[2],
+		home:      parts[5],
+		shell:     parts[6],
+	}
+	if len(lines) > 3 {
+		current.groups = strings.Fields(lines[3])
+	}
+	if len(lines) > 4 {
+		current.groupIds = strings.Fields(lines[4])
+	}
+
+	return lines[0], current, nil
+}
+
+// groupStatus determines the account tools available and the gid of the group, if it exists
+func (ei *ExecutionInstance) groupStatus(ctx context.Context, action *Action, name string) (string, int, bool, error) {
+	result, err := ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, []string{ei.config.Executor.ShellBinary, "-c", groupStatusScript, name})
+	if err != nil {
+		return "", 0, false, fmt.Errorf("unable to inspect group %s: %w", name, err)
+	}
+
+	lines := strings.Split(strings.TrimRight(string(result.stdout), "\n"), "\n")
+	if result.exitCode == missingAccountExitCode {
+		return lines[0], 0, false, nil
+	}
+	if result.exitCode != 0 {
+		return "", 0, false, fmt.Errorf("unable to inspect group %s: %w", name, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+	if len(lines) < 2 {
+		return "", 0, false, fmt.Errorf("unexpected group description: %s", result.stdout)
+	}
+
+	// name:password:gid:members
+	parts := strings.Split(lines[1], ":")
+	if len(parts) != 4 {
+		return "", 0, false, fmt.Errorf("unexpected group entry: %s", lines[1])
+	}
+	gid, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return "", 0, false, fmt.Errorf("unexpected gid in group entry: %s", lines[1])
+	}
+
+	return lines[0], gid, true, nil
+}
+
+// groupName resolves a group given by gid to its name, since the busybox applets only accept groups by name
+func (ei *ExecutionInstance) groupName(ctx context.Context, action *Action, group string) (string, error) {
+	if _, err := strconv.Atoi(group); err != nil {
+		return group, nil
+	}
+
+	result, err := ei.executeRemoteCommand(ctx, ei.clientFor(action), nil, []string{ei.config.Executor.ShellBinary, "-c", groupStatusScript, group})
+	if err != nil {
+		return "", fmt.Errorf("unable to resolve group %s: %w", group, err)
+	}
+	if result.exitCode == missingAccountExitCode {
+		return "", fmt.Errorf("unable to resolve group %s, no group has that gid", group)
+	}
+	if result.exitCode != 0 {
+		return "", fmt.Errorf("unable to resolve group %s: %w", group, cmdsession.NewExitCodeErrorWithStderr(result.exitCode, result.stderr))
+	}
+
+	// name:password:gid:members
+	lines := strings.Split(strings.TrimRight(string(result.stdout), "\n"), "\n")
+	if len(lines) < 2 {
+		return "", fmt.Errorf("unexpected group description: %s", result.stdout)
+	}
+	return strings.SplitN(lines[1], ":", 2)[0], nil
+}
+
+// missingAuthorizedKeys determines which of the keys are absent from the authorized keys of the user, along with the
+// current content of the authorized keys file
+func (ei *ExecutionInstance) missingAuthorizedKeys(ctx context.Context, action *Action, current *remoteUser, keys []string) ([]string, []byte, error) {
+	content, _, err := ei.readRemoteFile(ctx, action, ei.clientFor(action), current.home+"/.ssh/authorized_keys")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var present []string
+	for _, line := range strings.Split(string(content), "\n") {
+		present = append(present, strings.TrimSpace(line))
+	}
+
+	var missing []string
+	for _, key := range keys {
+		key = strings.TrimSpace(key)
+		if key != "" && !slices.Contains(present, key) && !slices.Contains(missing, key) {
+			missing = append(missing, key)
+		}
+	}
+
+	return missing, content, nil
+}
+
+// authorizeKeys appends those of the keys which are missing to the authorized keys of the user, creating the file and
+// its directory if needed
+func (ei *ExecutionInstance) authorizeKeys(ctx context.Context, action *Action, current *remoteUser, keys []string) (*actionResult, error) {
+	keys, content, err := ei.missingAuthorizedKeys(ctx, action, current, keys)
+	if err != nil || len(keys) == 0 {
+		return &actionResult{}, err
+	}
+
+	p := current.home + "/.ssh/authorized_keys"
+	appended := strings.Join(keys, "\n") + "\n"
+	if len(content) > 0 && !strings.HasSuffix(string(content), "\n") {
+		appended = "\n" + appended
+	}
+
+	return ei.runRemoteScript(ctx, action, authorizedKeysScript, p, strings.NewReader(appended), fmt.Sprintf("%d:%s", current.uid, current.gid))
+}
@@ -0,0 +1,215 @@
+package sequence
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeAccountTool stands in for getent, id and every account management command, depending on the name it is invoked
+// by.  accounts are looked up in passwd and group files, and every command which manages accounts is recorded in a log,
+// with useradd and addgroup also adding the account so that it can be found afterwards.
+const fakeAccountTool = `#!/bin/sh
+d=%[1]s
+t="${0##*/}"
+case "$t" in
+getent)
+	grep -E "^$2:|^[^:]*:[^:]*:$2:" "$d/$1" || exit 2;;
+id)
+	f=1; [ "$1" = "-G" ] && f=3
+	g=$(grep "^$2:" "$d/passwd" | cut -d: -f4)
+	grep -E "^[^:]*:[^:]*:$g:|[:,]$2(,|$)" "$d/group" | cut -d: -f$f | tr "\n" " "; echo;;
+*)
+	echo "$t $@" >> "$d/log"
+	case "$t" in
+	useradd|adduser)
+		u=1000; h=/home; s=/bin/sh
+		while [ $# -gt 1 ]; do
+			case "$1" in
+			-u) u="$2"; shift;;
+			-d|-h) h="$2"; shift;;
+			-s) s="$2"; shift;;
+			-g|-G) shift;;
+			esac
+			shift
+		done
+		echo "$1:x:$u:$u::$h:$s" >> "$d/passwd"
+		echo "$1:x:$u:" >> "$d/group";;
+	esac;;
+esac
+`
+
+// accountHost restricts the PATH to a directory holding the fake account tools and the tools the scripts require,
+// including the shadow utilities or only the busybox applets
+func accountHost(t *testing.T, shadow bool) (string, func() []string) {
+	dir := t.TempDir()
+	for _, tool := range []string{"sh", "grep", "cut", "tr", "cat", "mkdir", "chmod"} {
+		p, err := exec.LookPath(tool)
+		assert.NoError(t, err)
+		assert.NoError(t, os.Symlink(p, filepath.Join(dir, tool)))
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "account"), []byte(fmt.Sprintf(fakeAccountTool, dir)), 0o755))
+	tools := []string{"getent", "id", "chown", "adduser", "deluser", "addgroup", "delgroup"}
+	if shadow {
+		tools = append(tools, "useradd", "usermod", "userdel", "groupadd", "groupmod", "groupdel")
+	}
+	for _, tool := range tools {
+		assert.NoError(t, os.Symlink("account", filepath.Join(dir, tool)))
+	}
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "passwd"), []byte("root:x:0:0:root:/root:/bin/sh\n"), 0o644))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "group"), []byte("root:x:0:\ndocker:x:999:deploy\n"), 0o644))
+	t.Setenv("PATH", dir)
+
+	// the commands which managed accounts
+	invocations := func() []string {
+		content, err := os.ReadFile(filepath.Join(dir, "log"))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		assert.NoError(t, err)
+		assert.NoError(t, os.Remove(filepath.Join(dir, "log")))
+		return strings.Split(strings.TrimSpace(string(content)), "\n")
+	}
+
+	return dir, invocations
+}
+
+func TestUser(t *testing.T) {
+	dir, invocations := accountHost(t, true)
+	home := filepath.Join(t.TempDir(), "deploy")
+
+	uid := 1500
+	action := &Action{
+		Description: "user",
+		User: &User{
+			Name:           "deploy",
+			Uid:            &uid,
+			Groups:         []string{"docker"},
+			Shell:          "/bin/bash",
+			Home:           home,
+			AuthorizedKeys: []string{"ssh-ed25519 AAAA deploy@<!! .HostIdent !!>"},
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	exInst.config.Check = true
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"create user", "add 1 authorized key(s)"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+	assert.Empty(t, invocations())
+
+	exInst.config.Check = false
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{
+		fmt.Sprintf("useradd -u 1500 -G docker -s /bin/bash -d %s -m deploy", home),
+		fmt.Sprintf("chown 1500:1500 %s/.ssh", home),
+		fmt.Sprintf("chown 1500:1500 %s/.ssh/authorized_keys", home),
+	}, invocations())
+	content, err := os.ReadFile(filepath.Join(home, ".ssh", "authorized_keys"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 AAAA deploy@testhost\n", string(content))
+	assert.False(t, changed(t, exInst, action))
+	assert.Empty(t, invocations())
+
+	// supplementary groups can also be given by gid
+	action.User.Groups = []string{"999"}
+	assert.False(t, changed(t, exInst, action))
+	assert.Empty(t, invocations())
+
+	action.User.Shell = "/bin/zsh"
+	action.User.Groups = []string{"docker", "adm"}
+	action.User.AuthorizedKeys = append(action.User.AuthorizedKeys, "ssh-ed25519 BBBB backup")
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"shell /bin/bash -> /bin/zsh", "add to groups adm", "add 1 authorized key(s)"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+	assert.Equal(t, "usermod -s /bin/zsh -a -G adm deploy", invocations()[0])
+	content, err = os.ReadFile(filepath.Join(home, ".ssh", "authorized_keys"))
+	assert.NoError(t, err)
+	assert.Equal(t, "ssh-ed25519 AAAA deploy@testhost\nssh-ed25519 BBBB backup\n", string(content))
+
+	action.User = &User{Name: "deploy", State: accountStateAbsent}
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"userdel deploy"}, invocations())
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "passwd"), nil, 0o644))
+	assert.False(t, changed(t, exInst, action))
+
+	for _, invalid := range []*User{
+		{},
+		{Name: "deploy", State: "locked"},
+		{Name: "deploy", State: accountStateAbsent, Shell: "/bin/sh"},
+	} {
+		assert.Error(t, (&Action{User: invalid}).Validate())
+	}
+}
+
+func TestUserBusybox(t *testing.T) {
+	_, invocations := accountHost(t, false)
+
+	action := &Action{
+		Description: "user",
+		User: &User{
+			Name:   "phonk",
+			Group:  "docker",
+			Groups: []string{"adm"},
+			System: true,
+		},
+	}
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"adduser -D -G docker -S -H phonk", "addgroup phonk adm"}, invocations())
+
+	// the applets only accept groups by name, so gids are resolved to the names of their groups
+	action.User = &User{Name: "mosh", Group: "999", Groups: []string{"0"}}
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"adduser -D -G docker mosh", "addgroup mosh root"}, invocations())
+	action.User.Groups = []string{"1234"}
+	assert.Error(t, exInst.Execute(t.Context(), action))
+	assert.Empty(t, invocations())
+	action.User = &User{Name: "phonk", Group: "docker", Groups: []string{"adm"}}
+
+	// busybox can only add an existing user to groups
+	action.User.Shell = "/bin/ash"
+	assert.Error(t, exInst.Execute(t.Context(), action))
+	assert.Empty(t, invocations())
+}
+
+func TestGroup(t *testing.T) {
+	dir, invocations := accountHost(t, true)
+
+	gid := 2000
+	action := &Action{
+		Description: "group",
+		Group: &Group{
+			Name:   "app",
+			Gid:    &gid,
+			System: true,
+		},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"groupadd -g 2000 -r app"}, invocations())
+
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "group"), []byte("app:x:2000:\n"), 0o644))
+	assert.False(t, changed(t, exInst, action))
+
+	gid = 2001
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []any{"gid 2000 -> 2001"}, exInst.ExecContext.Get(ImmediateKey, "changes"))
+	assert.Equal(t, []string{"groupmod -g 2001 app"}, invocations())
+
+	action.Group = &Group{Name: "app", State: accountStateAbsent}
+	assert.True(t, changed(t, exInst, action))
+	assert.Equal(t, []string{"groupdel app"}, invocations())
+
+	assert.Error(t, (&Action{Group: &Group{Name: "app", State: accountStateAbsent, Gid: &gid}}).Validate())
+}
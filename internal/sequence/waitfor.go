@@ -0,0 +1,236 @@
+package sequence
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"regexp"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/frozengoats/crucible/internal/log"
+)
+
+const (
+	waitForPresent = "present"
+	waitForAbsent  = "absent"
+
+	defaultWaitForTimeout  = 300.0
+	defaultWaitForInterval = 1.0
+	// bounds a single check, so that an unresponsive port or url is retried rather than waited upon indefinitely
+	waitForCheckTimeout = 10.0
+)
+
+func (w *WaitFor) validate() error {
+	targets := 0
+	for _, set := range []bool{w.Port != 0, w.Path != "", w.Url != ""} {
+		if set {
+			targets++
+		}
+	}
+	if targets != 1 {
+		return fmt.Errorf("exactly one of port, path or url must be specified")
+	}
+
+	if w.Port < 0 || w.Port > 65535 {
+		return fmt.Errorf("port %d is out of range", w.Port)
+	}
+	if w.Host != "" && w.Port == 0 {
+		return fmt.Errorf("host can only be specified with a port")
+	}
+	if w.Regex != "" && w.Path == "" {
+		return fmt.Errorf("regex can only be specified with a path")
+	}
+	if (w.Status != 0 || w.Insecure) && w.Url == "" {
+		return fmt.Errorf("status and insecure can only be specified with a url")
+	}
+
+	switch w.State {
+	case "", waitForPresent:
+	case waitForAbsent:
+		if w.Url != "" {
+			return fmt.Errorf("a url can only be waited upon to be present")
+		}
+	default:
+		return fmt.Errorf("state must be one of %s or %s", waitForPresent, waitForAbsent)
+	}
+
+	if w.Timeout < 0 || w.Interval < 0 {
+		return fmt.Errorf("timeout and interval cannot be negative")
+	}
+
+	return nil
+}
+
+// portClosed determines whether a failure to connect to a port means that nothing is listening on it, as opposed to a
+// failure to dial at all, such as the connection to the host having been lost
+func portClosed(err error) bool {
+	if errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, context.DeadlineExceeded) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
+
+// waitFor polls a port, file or url from the host (or the local machine for local actions) until it reaches the
+// desired state, failing once the timeout elapses
+func (ei *ExecutionInstance) waitFor(ctx context.Context, action *Action) (*actionResult, error) {
+	waitAction := action.WaitFor
+	logCtx := []any{
+		"host", ei.hostIdent,
+	}
+
+	check, target, err := ei.waitForCheck(action)
+	if err != nil {
+		return nil, err
+	}
+
+	absent := waitAction.State == waitForAbsent
+	state := waitForPresent
+	if absent {
+		state = waitForAbsent
+	}
+
+	if ei.config.Check {
+		// whatever is being waited upon may well depend on the actions which check mode skipped
+		ei.addPlan(action, &PlannedAction{Dest: target})
+		log.Info(logCtx, "check mode, would wait for %s to be %s", target, state)
+		return &actionResult{}, nil
+	}
+
+	timeout := waitAction.Timeout
+	if timeout == 0 {
+		timeout = defaultWaitForTimeout
+	}
+	interval := waitAction.Interval
+	if interval == 0 {
+		interval = defaultWaitForInterval
+	}
+
+	ctx, cancel := withTimeout(ctx, timeout)
+	defer cancel()
+
+	start := time.Now()
+	for {
+		present, err := check(ctx)
+		if err != nil {
+			log.Debug(logCtx, "waiting for %s: %s", target, err.Error())
+		}
+		if err == nil && present != absent {
+			log.Info(logCtx, "%s is %s after %s", target, state, time.Since(start).Round(time.Millisecond))
+			return &actionResult{}, nil
+		}
+
+		err = sleep(ctx, interval)
+		if err != nil {
+			return nil, fmt.Errorf("%s did not become %s\n%w", target, state, err)
+		}
+	}
+}
+
+// waitForCheck renders the target of the action, producing a check of whether or not it is present along with a
+// description of the target
+func (ei *ExecutionInstance) waitForCheck(action *Action) (func(context.Context) (bool, error), string, error) {
+	waitAction := action.WaitFor
+	execClient := ei.clientFor(action)
+
+	switch {
+	case waitAction.Port != 0:
+		host, err := ei.renderString("waitFor host", waitAction.Host)
+		if err != nil {
+			return nil, "", err
+		}
+		if host == "" {
+			host = "localhost"
+		}
+		addr := net.JoinHostPort(host, strconv.Itoa(waitAction.Port))
+
+		return func(ctx context.Context) (bool, error) {
+			ctx, cancel := withTimeout(ctx, waitForCheckTimeout)
+			defer cancel()
+
+			conn, err := execClient.Dial(ctx, "tcp", addr)
+			if err != nil {
+				// a port which refuses connections or doesn't answer is closed as far as anyone using it is concerned
+				if portClosed(err) {
+					return false, nil
+				}
+				return false, err
+			}
+			_ = conn.Close()
+			return true, nil
+		}, "port " + addr, nil
+	case waitAction.Path != "":
+		p, err := ei.renderString("waitFor path", waitAction.Path)
+		if err != nil {
+			return nil, "", err
+		}
+		if waitAction.Regex == "" {
+			return func(ctx context.Context) (bool, error) {
+				return ei.remoteExists(ctx, action, execClient, p)
+			}, p, nil
+		}
+
+		expr, err := ei.renderString("waitFor regex", waitAction.Regex)
+		if err != nil {
+			return nil, "", err
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return nil, "", fmt.Errorf("unable to compile waitFor regex %s: %w", expr, err)
+		}
+
+		return func(ctx context.Context) (bool, error) {
+			content, exists, err := ei.readRemoteFile(ctx, action, execClient, p)
+			if err != nil {
+				return false, err
+			}
+			return exists && re.Match(content), nil
+		}, fmt.Sprintf("%s matching %s", p, expr), nil
+	default:
+		u, err := ei.renderString("waitFor url", waitAction.Url)
+		if err != nil {
+			return nil, "", err
+		}
+		status := waitAction.Status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		// connections are made from the host, so that the url is resolved exactly as it would be there.  redirects are
+		// not followed, the status of the url itself is what's waited upon.
+		client := &http.Client{
+			Transport: &http.Transport{
+				DialContext:       execClient.Dial,
+				TLSClientConfig:   &tls.Config{InsecureSkipVerify: waitAction.Insecure},
+				DisableKeepAlives: true,
+			},
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		}
+
+		return func(ctx context.Context) (bool, error) {
+			ctx, cancel := withTimeout(ctx, waitForCheckTimeout)
+			defer cancel()
+
+			req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+			if err != nil {
+				return false, err
+			}
+			resp, err := client.Do(req)
+			if err != nil {
+				return false, err
+			}
+			_ = resp.Body.Close()
+			if resp.StatusCode != status {
+				return false, fmt.Errorf("returned a status of %d rather than %d", resp.StatusCode, status)
+			}
+			return true, nil
+		}, u, nil
+	}
+}
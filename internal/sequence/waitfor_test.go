@@ -0,0 +1,109 @@
+package sequence
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/frozengoats/crucible/internal/cmdsession"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWaitForPort(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	port := listener.Addr().(*net.TCPAddr).Port
+
+	action := &Action{
+		Description: "wait for port",
+		WaitFor:     &WaitFor{Port: port, Host: "127.0.0.1", Timeout: 2, Interval: 0.05},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.False(t, changed(t, exInst, action))
+
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = listener.Close()
+	}()
+	action.WaitFor.State = "absent"
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+
+	// a port which can't be dialed at all isn't known to be closed, so waiting for its absence times out
+	seq := &Sequence{Sequence: []*Action{action}}
+	exInst, err = seq.NewExecutionInstance(&cmdsession.DummyExecutionClient{}, exInst.config, "testhost")
+	assert.NoError(t, err)
+	_, err = exInst.Next()
+	assert.NoError(t, err)
+	action.WaitFor.Timeout = 0.3
+	err = exInst.Execute(context.Background(), action)
+	assert.True(t, cmdsession.IsTimeoutError(err))
+}
+
+func TestWaitForFile(t *testing.T) {
+	p := filepath.Join(t.TempDir(), "ready")
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		_ = os.WriteFile(p, []byte("starting\n"), 0o644)
+		time.Sleep(200 * time.Millisecond)
+		_ = os.WriteFile(p, []byte("starting\nlistening on 8080\n"), 0o644)
+	}()
+
+	action := &Action{
+		Description: "wait for file",
+		WaitFor:     &WaitFor{Path: p, Regex: "listening on \\d+", Timeout: 2, Interval: 0.05},
+	}
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+
+	// the file never disappears, so waiting for its absence times out
+	action.WaitFor = &WaitFor{Path: p, State: "absent", Timeout: 0.3, Interval: 0.05}
+	err := exInst.Execute(context.Background(), action)
+	assert.True(t, cmdsession.IsTimeoutError(err))
+}
+
+func TestWaitForUrl(t *testing.T) {
+	ready := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !ready {
+			ready = true
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	action := &Action{
+		Description: "wait for url",
+		WaitFor:     &WaitFor{Url: server.URL + "/health", Status: http.StatusNoContent, Timeout: 2, Interval: 0.05},
+	}
+	assert.NoError(t, action.Validate())
+	exInst := syncInstance(t, action)
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+	assert.True(t, ready)
+
+	// the status of a redirect is that of the url itself, rather than wherever it redirects to
+	redirect := httptest.NewServer(http.RedirectHandler(server.URL+"/health", http.StatusFound))
+	defer redirect.Close()
+	action.WaitFor = &WaitFor{Url: redirect.URL, Status: http.StatusFound, Timeout: 2, Interval: 0.05}
+	assert.NoError(t, exInst.Execute(context.Background(), action))
+	action.WaitFor = &WaitFor{Url: redirect.URL, Status: http.StatusNoContent, Timeout: 0.3, Interval: 0.05}
+	assert.True(t, cmdsession.IsTimeoutError(exInst.Execute(context.Background(), action)))
+
+	for _, invalid := range []*WaitFor{
+		{},
+		{Port: 80, Path: "/tmp"},
+		{Url: "http://localhost", State: "absent"},
+		{Path: "/tmp", Status: 200},
+		{Port: 80, State: "open"},
+		{Port: 70000},
+	} {
+		assert.Error(t, (&Action{WaitFor: invalid}).Validate())
+	}
+}
@@ -1,6 +1,8 @@
 package ssh
 
 import (
+	"bytes"
+	"context"
 	"io"
 
 	"github.com/frozengoats/crucible/internal/cmdsession"
@@ -10,28 +12,59 @@ import (
 
 type SshCmdSession struct {
 	client *ssh.Client
+	stdout io.Writer
+	stderr io.Writer
 }
 
-// Execute executes a remote command session
-func (s *SshCmdSession) Execute(stdin io.Reader, cmd ...string) ([]byte, error) {
+func (s *SshCmdSession) SetOutputStreams(stdout io.Writer, stderr io.Writer) {
+	s.stdout = stdout
+	s.stderr = stderr
+}
+
+// Execute executes a remote command session, killing it should ctx be cancelled
+func (s *SshCmdSession) Execute(ctx context.Context, stdin io.Reader, cmd ...string) ([]byte, []byte, error) {
 	sess, err := s.client.NewSession()
 	if err != nil {
-		return nil, cmdsession.NewSessionError("unable to initiate new session: %", err.Error())
+		return nil, nil, cmdsession.NewSessionError("unable to initiate new session: %", err.Error())
 	}
 
 	if stdin != nil {
 		sess.Stdin = stdin
 	}
 
-	output, err := sess.Output(utils.Quote(cmd...))
+	var stdout, stderr bytes.Buffer
+	sess.Stdout = &stdout
+	sess.Stderr = &stderr
+	if s.stdout != nil {
+		sess.Stdout = io.MultiWriter(&stdout, s.stdout)
+		sess.Stderr = io.MultiWriter(&stderr, s.stderr)
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// not every server honours signals, closing the session ensures that Run returns regardless
+			_ = sess.Signal(ssh.SIGKILL)
+			_ = sess.Close()
+		case <-done:
+		}
+	}()
+
+	err = sess.Run(utils.Quote(cmd...))
 	if err != nil {
+		if ctx.Err() != nil {
+			return stdout.Bytes(), stderr.Bytes(), context.Cause(ctx)
+		}
+
 		exitErr, ok := err.(*ssh.ExitError)
 		if ok {
-			return nil, cmdsession.NewExitCodeError(exitErr.ExitStatus())
+			return stdout.Bytes(), stderr.Bytes(), cmdsession.NewExitCodeError(exitErr.ExitStatus())
 		}
 
-		return nil, err
+		return nil, nil, err
 	}
 
-	return output, nil
+	return stdout.Bytes(), stderr.Bytes(), nil
 }
@@ -2,9 +2,12 @@ package ssh
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"net"
 	"os"
+	"syscall"
 	"time"
 
 	"github.com/frozengoats/crucible/internal/cmdsession"
@@ -164,7 +167,7 @@ func (s *SshSession) hostKeyCallback(hostname string, remote net.Addr, key ssh.P
 	return err
 }
 
-func (s *SshSession) Connect() error {
+func (s *SshSession) Connect(ctx context.Context) error {
 	if s.client != nil {
 		return nil
 	}
@@ -227,12 +230,29 @@ func (s *SshSession) Connect() error {
 
 	host := s.hostname
 	host = fmt.Sprintf("%s:%d", host, s.port)
-	client, err := ssh.Dial("tcp", host, sshConfig)
+	dialer := &net.Dialer{Timeout: sshConfig.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
 	if err != nil {
 		return fmt.Errorf("unable to establish ssh connection for %s\n%w", host, err)
 	}
 
-	s.client = client
+	// the handshake is abandoned by closing the connection if ctx is cancelled before it completes
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	clientConn, chans, reqs, err := ssh.NewClientConn(conn, host, sshConfig)
+	if !stop() {
+		if err == nil {
+			_ = clientConn.Close()
+		}
+		return fmt.Errorf("unable to establish ssh connection for %s\n%w", host, context.Cause(ctx))
+	}
+	if err != nil {
+		_ = conn.Close()
+		return fmt.Errorf("unable to establish ssh connection for %s\n%w", host, err)
+	}
+
+	s.client = ssh.NewClient(clientConn, chans, reqs)
 	return nil
 }
 
@@ -241,3 +261,18 @@ func (s *SshSession) NewCmdSession() (cmdsession.CmdSession, error) {
 		client: s.client,
 	}, nil
 }
+
+// Dial opens a connection to the address from the remote host, tunnelled through the ssh connection
+func (s *SshSession) Dial(ctx context.Context, network string, addr string) (net.Conn, error) {
+	if s.client == nil {
+		return nil, cmdsession.NewSessionError("unable to dial %s, no ssh connection is established", addr)
+	}
+
+	conn, err := s.client.DialContext(ctx, network, addr)
+	var openErr *ssh.OpenChannelError
+	if errors.As(err, &openErr) && openErr.Reason == ssh.ConnectionFailed {
+		// the host was unable to connect to the address, which is reported in the same way as a local dial would be
+		return nil, &net.OpError{Op: "dial", Net: network, Err: fmt.Errorf("%s: %w", openErr.Message, syscall.ECONNREFUSED)}
+	}
+	return conn, err
+}
@@ -31,50 +31,6 @@ var (
 	AgentSocketFile string = filepath.Join(AgentUnixSocketDir, "agent.sock")
 )
 
-var dirName = "/tmp/rsync_test"
-
-func touch(path string) error {
-	return os.WriteFile(path, []byte{}, 0o777)
-}
-
-func prepTestEnvironment() error {
-	_ = os.RemoveAll(dirName)
-	err := os.MkdirAll(dirName, 0o777)
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(filepath.Join(dirName, "sub1_a", "sub2_a"), 0o777)
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(filepath.Join(dirName, "sub1_b", "sub2_a"), 0o777)
-	if err != nil {
-		return err
-	}
-
-	err = os.MkdirAll(filepath.Join(dirName, "sub1_b", "sub2_b"), 0o777)
-	if err != nil {
-		return err
-	}
-
-	files := []string{
-		filepath.Join(dirName, "file.txt"),
-		filepath.Join(dirName, "sub1_a", "file.txt"),
-		filepath.Join(dirName, "sub1_a", "file1.txt"),
-		filepath.Join(dirName, "sub1_b", "sub2_b", "file.txt"),
-	}
-	for _, f := range files {
-		err := touch(f)
-		if err != nil {
-			return err
-		}
-	}
-
-	return nil
-}
-
 type SshTestSuite struct {
 	suite.Suite
 
@@ -194,7 +150,7 @@ func (suite *SshTestSuite) TestUnknownHostDontAllow() {
 	}()
 
 	// should fail b/c host is unknown and we don't allow for that
-	err := sshSession.Connect()
+	err := sshSession.Connect(context.Background())
 	suite.Error(err)
 }
 
@@ -207,7 +163,7 @@ func (suite *SshTestSuite) TestUnknownHostAllow() {
 		_ = sshSession.Close()
 	}()
 
-	err := sshSession.Connect()
+	err := sshSession.Connect(context.Background())
 	suite.NoError(err)
 }
 
@@ -219,7 +175,7 @@ func (suite *SshTestSuite) TestKnownHostNoProblem() {
 	defer func() {
 		_ = sshSession.Close()
 	}()
-	err := sshSession.Connect()
+	err := sshSession.Connect(context.Background())
 	suite.NoError(err)
 
 	// this time, fail if a host is unknown.  it should already be part of our known_hosts though, so it should pass
@@ -227,7 +183,7 @@ func (suite *SshTestSuite) TestKnownHostNoProblem() {
 	defer func() {
 		_ = sshSession.Close()
 	}()
-	err = sshSession.Connect()
+	err = sshSession.Connect(context.Background())
 	suite.NoError(err)
 }
 
@@ -240,7 +196,7 @@ func (suite *SshTestSuite) TestKeyWithPassphrase() {
 		_ = sshSession.Close()
 	}()
 
-	err := sshSession.Connect()
+	err := sshSession.Connect(context.Background())
 	suite.Error(err)
 
 	// admit entry once by providing the passphrase when prompted with the correct passphrase
@@ -248,7 +204,7 @@ func (suite *SshTestSuite) TestKeyWithPassphrase() {
 	defer func() {
 		_ = sshSession.Close()
 	}()
-	err = sshSession.Connect()
+	err = sshSession.Connect(context.Background())
 	suite.NoError(err)
 
 	// admit entry even with empty phrase, because agent should now hold the unlocked key
@@ -256,33 +212,7 @@ func (suite *SshTestSuite) TestKeyWithPassphrase() {
 	defer func() {
 		_ = sshSession.Close()
 	}()
-	err = sshSession.Connect()
-	suite.NoError(err)
-}
-
-func (suite *SshTestSuite) TestRsyncNoPassphrase() {
-	// prepare ssh session
-	privKey := filepath.Join(suite.testDataDir, "id_ed25519")
-
-	// allow the unknown host to be connected to
-	sshSession := NewSsh(suite.sshHost, suite.sshPort, "test", privKey, KnownHostsFile, WithAllowUnknownHostsOption(true), WithPassphraseProviderOption(NewTypedPassphraseProvider()))
-	defer func() {
-		_ = sshSession.Close()
-	}()
-
-	err := sshSession.Connect()
-	suite.NoError(err)
-	defer func() {
-		_ = sshSession.Close()
-	}()
-	suite.NoError(err)
-
-	err = prepTestEnvironment()
-	suite.NoError(err)
-
-	_ = os.Chmod(privKey, 0o600)
-
-	err = Rsync("test", suite.sshHost, suite.sshPort, privKey, "/tmp/rsync_test", "/tmp/target", "-o", fmt.Sprintf("UserKnownHostsFile=%s", KnownHostsFile))
+	err = sshSession.Connect(context.Background())
 	suite.NoError(err)
 }
 
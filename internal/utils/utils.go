@@ -3,6 +3,8 @@ package utils
 import (
 	"fmt"
 	"strings"
+
+	"github.com/pmezard/go-difflib/difflib"
 )
 
 func Quote(parts ...string) string {
@@ -36,3 +38,15 @@ func Quote(parts ...string) string {
 func Combine(parts ...string) string {
 	return strings.Join(parts, " ")
 }
+
+// UnifiedDiff returns a unified diff between the original and the updated content, or an empty
+// string if the two are identical
+func UnifiedDiff(original []byte, updated []byte, name string) (string, error) {
+	return difflib.GetUnifiedDiffString(difflib.UnifiedDiff{
+		A:        difflib.SplitLines(string(original)),
+		B:        difflib.SplitLines(string(updated)),
+		FromFile: fmt.Sprintf("%s (current)", name),
+		ToFile:   fmt.Sprintf("%s (desired)", name),
+		Context:  3,
+	})
+}
@@ -6,12 +6,14 @@ import (
 	"net/url"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/alecthomas/kong"
 	"github.com/frozengoats/crucible/internal/crucible"
 	"github.com/frozengoats/crucible/internal/executor"
 	"github.com/frozengoats/crucible/internal/log"
 	"github.com/frozengoats/crucible/internal/oci"
+	"github.com/frozengoats/crucible/internal/sequence"
 	"golang.org/x/term"
 )
 
@@ -131,13 +133,17 @@ func (c *PublishCmd) Run() error {
 }
 
 type RunCmd struct {
-	Configs  []string `short:"c" help:"list of paths to any config yaml overrides, stackable in order of occurrence"`
-	Values   []string `short:"v" help:"list of paths to values files, stackable in order of occurrence"`
-	Sequence string   `arg:"" help:"the name of the sequence to execute"`
-	Targets  []string `arg:"" help:"named machine targets and/or groups against which to execute the sequence (\"all\" for all targets)"`
-	Debug    bool     `short:"d" help:"enable debug mode"`
-	Version  bool     `help:"display the current version"`
-	Json     bool     `short:"j" help:"output results in json format, suppress normal logging"`
+	Configs  []string      `short:"c" help:"list of paths to any config yaml overrides, stackable in order of occurrence"`
+	Values   []string      `short:"v" help:"list of paths to values files, stackable in order of occurrence"`
+	Sequence string        `arg:"" help:"the name of the sequence to execute"`
+	Targets  []string      `arg:"" help:"named machine targets and/or groups against which to execute the sequence (\"all\" for all targets)"`
+	Debug    bool          `short:"d" help:"enable debug mode"`
+	Version  bool          `help:"display the current version"`
+	Json     bool          `short:"j" help:"output results in json format, suppress normal logging"`
+	Check    bool          `help:"evaluate the sequence and report what would be executed on each host, without executing anything"`
+	Diff     bool          `help:"display a diff of remote file changes made by template actions"`
+	Stream   bool          `help:"stream the output of commands as it arrives, prefixed by host"`
+	Timeout  time.Duration `help:"maximum duration of the whole run (e.g. 30m), after which running commands are terminated"`
 }
 
 type InfoCmd struct {
@@ -175,13 +181,21 @@ func (c *RunCmd) Run() error {
 		return err
 	}
 
-	jsonResult, err := crucible.ExecuteSequenceFromCwd(cwd, c.Configs, c.Values, c.Sequence, c.Targets, c.Debug, c.Json)
+	jsonResult, err := crucible.ExecuteSequenceFromCwd(cwd, c.Configs, c.Values, c.Sequence, c.Targets, &crucible.RunOptions{
+		Debug:   c.Debug,
+		Json:    c.Json,
+		Check:   c.Check,
+		Diff:    c.Diff,
+		Stream:  c.Stream,
+		Timeout: c.Timeout,
+	})
 	if c.Json {
 		if jsonResult == nil {
 			r := executor.ResultObj{
 				Error:        err.Error(),
 				SuccessHosts: []string{},
 				FailHosts:    []*executor.FailedHost{},
+				Stats:        map[string]*sequence.ActionStats{},
 			}
 			rBytes, err := json.Marshal(r)
 			if err != nil {